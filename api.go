@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/protomem/msg-processor/pkg/ctxstore"
 )
@@ -12,6 +13,10 @@ import (
 type APIServerOptions struct {
 	ListenAddr string
 	BaseURL    string
+
+	Validation ValidationOptions
+
+	IdempotencyTTL time.Duration
 }
 
 type APIServer struct {
@@ -61,21 +66,20 @@ func MakeHTTPHandleFunc(log *slog.Logger, handler string, fn APIHandlerFunc) htt
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := ctxstore.With(r.Context(), HandlerKey, handler)
 		if err := fn(w, r.WithContext(ctx)); err != nil {
+			apiErr := AsAPIError(err)
+
 			log.Warn(
 				"failed to process request",
 				"error", err,
+				"status", apiErr.StatusCode(),
 				TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
 				HandlerKey.String(), ctxstore.MustFrom[string](ctx, HandlerKey),
 			)
-			_ = WriteJSON(w, http.StatusInternalServerError, APIError{Error: http.StatusText(http.StatusInternalServerError)})
+			_ = WriteJSON(w, apiErr.StatusCode(), apiErr)
 		}
 	}
 }
 
-type APIError struct {
-	Error string `json:"error"`
-}
-
 type JSONObject map[string]any
 
 func WriteJSON(w http.ResponseWriter, code int, v any) error {
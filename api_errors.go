@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+type APIErrorCode string
+
+const (
+	APICodeValidation  APIErrorCode = "validation"
+	APICodeTooLarge    APIErrorCode = "too_large"
+	APICodeNotFound    APIErrorCode = "not_found"
+	APICodeConflict    APIErrorCode = "conflict"
+	APICodeUnavailable APIErrorCode = "unavailable"
+	APICodeInternal    APIErrorCode = "internal"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// APIError is an error returned by handlers and written as the response body.
+type APIError struct {
+	Code    APIErrorCode `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+
+	status int
+	cause  error
+}
+
+func NewValidationError(message string, fields ...FieldError) *APIError {
+	return &APIError{Code: APICodeValidation, Message: message, Fields: fields, status: http.StatusBadRequest}
+}
+
+func NewTooLargeError(message string) *APIError {
+	return &APIError{Code: APICodeTooLarge, Message: message, status: http.StatusRequestEntityTooLarge}
+}
+
+func NewNotFoundError(message string) *APIError {
+	return &APIError{Code: APICodeNotFound, Message: message, status: http.StatusNotFound}
+}
+
+func NewConflictError(message string) *APIError {
+	return &APIError{Code: APICodeConflict, Message: message, status: http.StatusConflict}
+}
+
+func NewUnavailableError(message string, cause error) *APIError {
+	return &APIError{Code: APICodeUnavailable, Message: message, status: http.StatusServiceUnavailable, cause: cause}
+}
+
+func NewInternalError(cause error) *APIError {
+	return &APIError{
+		Code:    APICodeInternal,
+		Message: http.StatusText(http.StatusInternalServerError),
+		status:  http.StatusInternalServerError,
+		cause:   cause,
+	}
+}
+
+func (e *APIError) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%s: %s: %s", e.Code, e.Message, e.cause)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.cause
+}
+
+func (e *APIError) StatusCode() int {
+	return e.status
+}
+
+// AsAPIError maps errors returned by handlers, storages and queues to API errors.
+func AsAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var (
+		constraintErr *ConstraintError
+		netErr        net.Error
+	)
+	switch {
+	case errors.Is(err, ErrMsgNotFound):
+		return NewNotFoundError(ErrMsgNotFound.Error())
+	case errors.Is(err, ErrMsgEmptyText):
+		return NewValidationError("invalid message", FieldError{Field: "message", Message: "must not be empty"})
+	case errors.Is(err, ErrConflict):
+		return NewConflictError(err.Error())
+	case errors.As(err, &constraintErr):
+		return NewValidationError("constraint violation", FieldError{Field: constraintErr.Field, Message: constraintErr.Message})
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrQueueClosed), errors.As(err, &netErr):
+		return NewUnavailableError(http.StatusText(http.StatusServiceUnavailable), err)
+	default:
+		return NewInternalError(err)
+	}
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"expvar"
+	"fmt"
+	"mime"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/protomem/msg-processor/docs"
 	"github.com/protomem/msg-processor/pkg/ctxstore"
@@ -24,7 +30,14 @@ func (s *APIServer) setupRoutes() http.Handler {
 	router.HandleFunc("GET /health", MakeHTTPHandleFunc(s.log, "health", s.handleHealth))
 
 	router.HandleFunc("POST /api/msg", MakeHTTPHandleFunc(s.log, "saveMessage", s.handleSaveMessage))
+	router.HandleFunc("POST /api/msg/batch", MakeHTTPHandleFunc(s.log, "saveMessages", s.handleSaveMessages))
 	router.HandleFunc("GET /api/msg", MakeHTTPHandleFunc(s.log, "messageStatistics", s.handleMessageStatistics))
+	router.HandleFunc("GET /api/msg/{id}", MakeHTTPHandleFunc(s.log, "getMessage", s.handleGetMessage))
+	router.HandleFunc("GET /api/msgs", MakeHTTPHandleFunc(s.log, "listMessages", s.handleListMessages))
+
+	router.HandleFunc("GET /api/dlq", MakeHTTPHandleFunc(s.log, "listDeadLetters", s.handleListDeadLetters))
+
+	router.Handle("GET /debug/vars", expvar.Handler())
 
 	router.HandleFunc("/swagger/", httpSwagger.Handler(
 		httpSwagger.URL(
@@ -46,9 +59,14 @@ func (s *APIServer) handleHealth(w http.ResponseWriter, _ *http.Request) error {
 //	@Tags			message
 //	@Accept			json
 //	@Produce		json
-//	@Param			message	body		SaveMessageDTO	true	"Message"
-//	@Success		201		{object}	Message
-//	@Failure		500		{object}	any
+//	@Param			message			body		SaveMessageDTO	true	"Message"
+//	@Param			Idempotency-Key	header		string			false	"Key to safely retry the request"
+//	@Success		201				{object}	Message
+//	@Failure		400				{object}	APIError
+//	@Failure		409				{object}	APIError	"Idempotency key is used with another request or in progress"
+//	@Failure		413				{object}	APIError
+//	@Failure		500				{object}	APIError
+//	@Failure		503				{object}	APIError
 //	@Router			/msg [post]
 func (s *APIServer) handleSaveMessage(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -58,40 +76,188 @@ func (s *APIServer) handleSaveMessage(w http.ResponseWriter, r *http.Request) er
 	)
 
 	var dto SaveMessageDTO
-	if err := json.NewDecoder(r.Body).Decode(&dto); err != nil {
+	if err := DecodeJSONBody(w, r, s.opts.Validation.MaxBodySize, &dto); err != nil {
+		return err
+	}
+
+	if err := dto.Validate(s.opts.Validation); err != nil {
 		return err
 	}
 
 	log.Debug("received request")
 
-	msgID, err := s.store.SaveMessage(ctx, dto)
+	idemKey, requestHash, err := parseIdempotencyKey(r, dto)
 	if err != nil {
 		return err
 	}
 
-	msg, err := s.store.GetMessage(ctx, msgID)
+	var msg Message
+	if idemKey == "" {
+		msgID, err := s.store.SaveMessage(ctx, dto)
+		if err != nil {
+			return err
+		}
+
+		msg, err = s.store.GetMessage(ctx, msgID)
+		if err != nil {
+			return err
+		}
+	} else {
+		// The response is saved with the message, so a retry gets the same response and never saves a duplicate.
+		existing, saved, err := s.store.SaveIdempotentMessage(
+			ctx, idemKey, requestHash, s.opts.IdempotencyTTL, dto,
+			func(saved Message) (int, []byte, error) {
+				msg = saved
+				msgJSON, err := json.Marshal(saved)
+				return http.StatusCreated, msgJSON, err
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		if !saved {
+			if err := checkIdempotentReplay(existing, requestHash); err != nil {
+				return err
+			}
+
+			log.Debug("replayed response", "msgId", existing.MessageID)
+
+			return replayIdempotentResponse(w, existing)
+		}
+	}
+
+	// The event is published to the queue by the outbox relay task.
+	log.Debug("saved message", "msgId", msg.ID)
+
+	return WriteJSON(w, http.StatusCreated, msg)
+}
+
+// Handle Save Messages
+//
+//	@Summary		Save messages
+//	@Description	Save a batch of messages as a JSON array or as NDJSON (application/x-ndjson).
+//	@Description	Invalid items are reported in the results, valid items are saved in one transaction.
+//	@Tags			message
+//	@Accept			json
+//	@Accept			application/x-ndjson
+//	@Produce		json
+//	@Param			messages	body		[]SaveMessageDTO	true	"Messages"
+//	@Success		201			{object}	SaveMessagesResultDTO	"All messages are saved"
+//	@Success		207			{object}	SaveMessagesResultDTO	"Some messages are not saved"
+//	@Failure		400			{object}	APIError
+//	@Failure		413			{object}	APIError
+//	@Failure		500			{object}	APIError
+//	@Failure		503			{object}	APIError
+//	@Router			/msg/batch [post]
+func (s *APIServer) handleSaveMessages(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := s.log.With(
+		HandlerKey.String(), ctxstore.MustFrom[string](ctx, HandlerKey),
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	body, err := ReadBody(w, r, s.opts.Validation.MaxBatchBodySize)
 	if err != nil {
 		return err
 	}
-	msg.Status = MessageProcessing
 
-	msgJSON, err := json.Marshal(msg)
+	var items []json.RawMessage
+	if isNDJSON(r) {
+		items = splitNDJSON(body)
+	} else if err := DecodeJSON(body, &items); err != nil {
+		return err
+	}
+
+	if len(items) == 0 {
+		return invalidBody("must contain at least one message")
+	}
+	if s.opts.Validation.MaxBatchSize > 0 && len(items) > s.opts.Validation.MaxBatchSize {
+		return invalidBody(fmt.Sprintf("must contain at most %d messages", s.opts.Validation.MaxBatchSize))
+	}
+
+	log.Debug("received request", "countItems", len(items))
+
+	res := SaveMessagesResultDTO{Results: make([]SaveMessageResultDTO, len(items))}
+
+	dtos := make([]SaveMessageDTO, 0, len(items))
+	dtoIndexes := make([]int, 0, len(items))
+	for i, item := range items {
+		res.Results[i].Index = i
+
+		var dto SaveMessageDTO
+		err := DecodeJSON(item, &dto)
+		if err == nil {
+			err = dto.Validate(s.opts.Validation)
+		}
+		if err != nil {
+			res.Results[i].Error = AsAPIError(err)
+			res.Failed++
+			continue
+		}
+
+		dtos = append(dtos, dto)
+		dtoIndexes = append(dtoIndexes, i)
+	}
+
+	// The messages are inserted in one statement. Their events are published by the outbox relay task
+	// in batches of RELAY_OUTBOX_BATCH_SIZE shared with other requests, not in a single write per request.
+	msgs, err := s.store.SaveMessages(ctx, dtos)
 	if err != nil {
 		return err
 	}
 
-	evt := NewEvent([]byte("newMessage"), msgJSON)
-	if err := s.queue.WriteEvents(ctx, evt); err != nil {
+	for i, msg := range msgs {
+		res.Results[dtoIndexes[i]].Message = &msg
+		res.Succeeded++
+	}
+
+	log.Debug("saved messages", "countSucceeded", res.Succeeded, "countFailed", res.Failed)
+
+	if res.Failed > 0 {
+		return WriteJSON(w, http.StatusMultiStatus, res)
+	}
+	return WriteJSON(w, http.StatusCreated, res)
+}
+
+// Handle Get Message
+//
+//	@Summary		Get message
+//	@Description	Get message by id with its processing results
+//	@Tags			message
+//	@Accept			json
+//	@Produce		json
+//	@Param			id	path		int	true	"Message ID"
+//	@Success		200	{object}	MessageDetailsDTO
+//	@Failure		400	{object}	APIError
+//	@Failure		404	{object}	APIError
+//	@Failure		500	{object}	APIError
+//	@Router			/msg/{id} [get]
+func (s *APIServer) handleGetMessage(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := s.log.With(
+		HandlerKey.String(), ctxstore.MustFrom[string](ctx, HandlerKey),
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	msgID, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return NewValidationError("invalid message id", FieldError{Field: "id", Message: "must be an unsigned integer"})
+	}
+
+	msg, err := s.store.GetMessage(ctx, msgID)
+	if err != nil {
 		return err
 	}
 
-	if err := s.store.UpdateStatusMessages(ctx, []uint64{msgID}, MessageProcessing); err != nil {
+	results, err := s.store.GetProcessingResults(ctx, msgID)
+	if err != nil {
 		return err
 	}
 
-	log.Debug("saved message", "msgId", msg.ID)
+	log.Debug("get message", "msgId", msg.ID, "countResults", len(results))
 
-	return WriteJSON(w, http.StatusCreated, msg)
+	return WriteJSON(w, http.StatusOK, MessageDetailsDTO{Message: msg, Results: results})
 }
 
 // Handle Message Statistics
@@ -102,7 +268,7 @@ func (s *APIServer) handleSaveMessage(w http.ResponseWriter, r *http.Request) er
 //	@Accept			json
 //	@Produce		json
 //	@Success		200	{object}	MessageStatisticsDTO
-//	@Failure		500	{object}	any
+//	@Failure		500	{object}	APIError
 //	@Router			/msg [get]
 func (s *APIServer) handleMessageStatistics(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -126,7 +292,198 @@ func (s *APIServer) handleMessageStatistics(w http.ResponseWriter, r *http.Reque
 		return err
 	}
 
+	stats.Failed, err = s.store.CountFailedMessages(ctx)
+	if err != nil {
+		return err
+	}
+
+	stats.DeadLetter, err = s.store.CountDeadLetterMessages(ctx)
+	if err != nil {
+		return err
+	}
+
 	log.Debug("get message statistics")
 
 	return WriteJSON(w, http.StatusOK, stats)
 }
+
+const (
+	_defaultListLimit = 20
+	_maxListLimit     = 100
+)
+
+// Handle List Messages
+//
+//	@Summary		List messages
+//	@Description	List messages with keyset pagination by id
+//	@Tags			message
+//	@Accept			json
+//	@Produce		json
+//	@Param			status		query		MessageStatus	false	"Message status"
+//	@Param			createdFrom	query		string			false	"Created at or after (RFC3339)"
+//	@Param			createdTo	query		string			false	"Created before (RFC3339)"
+//	@Param			text		query		string			false	"Text substring (case insensitive)"
+//	@Param			order		query		SortOrder		false	"Sort order by id"	default(asc)
+//	@Param			cursor		query		string			false	"Cursor from the previous page"
+//	@Param			limit		query		int				false	"Page size"	default(20)	maximum(100)
+//	@Success		200			{object}	MessageListDTO
+//	@Failure		400			{object}	APIError
+//	@Failure		500			{object}	APIError
+//	@Router			/msgs [get]
+func (s *APIServer) handleListMessages(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := s.log.With(
+		HandlerKey.String(), ctxstore.MustFrom[string](ctx, HandlerKey),
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	dto, err := parseListMessagesDTO(r)
+	if err != nil {
+		return err
+	}
+
+	// One extra message is requested to find out whether there is a next page.
+	limit := dto.Limit
+	dto.Limit++
+
+	msgs, err := s.store.ListMessages(ctx, dto)
+	if err != nil {
+		return err
+	}
+
+	var res MessageListDTO
+	if uint64(len(msgs)) > limit {
+		msgs = msgs[:limit]
+		res.NextCursor = strconv.FormatUint(msgs[len(msgs)-1].ID, 10)
+	}
+	res.Messages = msgs
+
+	log.Debug("list messages", "countMsgs", len(msgs))
+
+	return WriteJSON(w, http.StatusOK, res)
+}
+
+// Handle List Dead Letters
+//
+//	@Summary		List dead letters
+//	@Description	List events sent to the dead-letter queue with keyset pagination by id
+//	@Tags			dlq
+//	@Accept			json
+//	@Produce		json
+//	@Param			cursor	query		string	false	"Cursor from the previous page"
+//	@Param			limit	query		int		false	"Page size"	default(20)	maximum(100)
+//	@Success		200		{object}	DeadLetterListDTO
+//	@Failure		400		{object}	APIError
+//	@Failure		500		{object}	APIError
+//	@Router			/dlq [get]
+func (s *APIServer) handleListDeadLetters(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := s.log.With(
+		HandlerKey.String(), ctxstore.MustFrom[string](ctx, HandlerKey),
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	cursor, limit, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+
+	// One extra dead letter is requested to find out whether there is a next page.
+	letters, err := s.store.ListDeadLetters(ctx, ListDeadLettersDTO{Cursor: cursor, Limit: limit + 1})
+	if err != nil {
+		return err
+	}
+
+	var res DeadLetterListDTO
+	if uint64(len(letters)) > limit {
+		letters = letters[:limit]
+		res.NextCursor = strconv.FormatUint(letters[len(letters)-1].ID, 10)
+	}
+	res.DeadLetters = letters
+
+	log.Debug("list dead letters", "countDeadLetters", len(letters))
+
+	return WriteJSON(w, http.StatusOK, res)
+}
+
+func parseListMessagesDTO(r *http.Request) (ListMessagesDTO, error) {
+	var (
+		err   error
+		query = r.URL.Query()
+		dto   = ListMessagesDTO{Order: SortAsc}
+	)
+
+	if v := query.Get("status"); v != "" {
+		dto.Status = MessageStatus(v)
+		if !dto.Status.Valid() {
+			return ListMessagesDTO{}, invalidQueryParam("status", "must be one of created, processing, completed, failed, dead_letter")
+		}
+	}
+
+	if v := query.Get("createdFrom"); v != "" {
+		if dto.CreatedFrom, err = time.Parse(time.RFC3339, v); err != nil {
+			return ListMessagesDTO{}, invalidQueryParam("createdFrom", "must be a RFC3339 timestamp")
+		}
+	}
+
+	if v := query.Get("createdTo"); v != "" {
+		if dto.CreatedTo, err = time.Parse(time.RFC3339, v); err != nil {
+			return ListMessagesDTO{}, invalidQueryParam("createdTo", "must be a RFC3339 timestamp")
+		}
+	}
+
+	dto.Text = query.Get("text")
+
+	if v := query.Get("order"); v != "" {
+		dto.Order = SortOrder(v)
+		if dto.Order != SortAsc && dto.Order != SortDesc {
+			return ListMessagesDTO{}, invalidQueryParam("order", "must be asc or desc")
+		}
+	}
+
+	if dto.Cursor, dto.Limit, err = parsePage(r); err != nil {
+		return ListMessagesDTO{}, err
+	}
+
+	return dto, nil
+}
+
+func parsePage(r *http.Request) (cursor uint64, limit uint64, err error) {
+	query := r.URL.Query()
+	limit = _defaultListLimit
+
+	if v := query.Get("cursor"); v != "" {
+		if cursor, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return 0, 0, invalidQueryParam("cursor", "must be a cursor from the previous page")
+		}
+	}
+
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.ParseUint(v, 10, 64); err != nil || limit == 0 || limit > _maxListLimit {
+			return 0, 0, invalidQueryParam("limit", fmt.Sprintf("must be between 1 and %d", _maxListLimit))
+		}
+	}
+
+	return cursor, limit, nil
+}
+
+func invalidQueryParam(name, message string) *APIError {
+	return NewValidationError("invalid query parameter", FieldError{Field: name, Message: message})
+}
+
+func isNDJSON(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-ndjson" || mediaType == "application/ndjson"
+}
+
+func splitNDJSON(body []byte) []json.RawMessage {
+	items := make([]json.RawMessage, 0)
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		items = append(items, line)
+	}
+	return items
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	_maxIdempotencyKeyLength = 255
+)
+
+// parseIdempotencyKey returns the Idempotency-Key of the request and the hash of the request body.
+func parseIdempotencyKey(r *http.Request, body any) (key, requestHash string, err error) {
+	key = r.Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		return "", "", nil
+	}
+
+	if len(key) > _maxIdempotencyKeyLength {
+		return "", "", NewValidationError("invalid header", FieldError{
+			Field:   IdempotencyKeyHeader,
+			Message: fmt.Sprintf("must be at most %d characters", _maxIdempotencyKeyLength),
+		})
+	}
+
+	requestHash, err = hashRequestBody(body)
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, requestHash, nil
+}
+
+// checkIdempotentReplay checks that the existing key can be replayed for the request.
+func checkIdempotentReplay(existing IdempotencyKey, requestHash string) error {
+	switch {
+	case existing.RequestHash != requestHash:
+		return NewConflictError("idempotency key is already used with another request body")
+	case !existing.Completed():
+		return NewConflictError("request with the idempotency key is in progress")
+	default:
+		return nil
+	}
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, key IdempotencyKey) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(IdempotentReplayedHeader, strconv.FormatBool(true))
+	w.WriteHeader(key.ResponseStatus)
+	_, err := w.Write(key.ResponseBody)
+	return err
+}
+
+func hashRequestBody(body any) (string, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -55,7 +55,7 @@ func (s *APIServer) recovery(next http.Handler) http.Handler {
 			if err := recover(); err != nil {
 				tid := ctxstore.MustFrom[string](r.Context(), TraceIDKey)
 				s.log.Error("panic occurred", "error", err, TraceIDKey.String(), tid)
-				_ = WriteJSON(w, http.StatusInternalServerError, APIError{Error: http.StatusText(http.StatusInternalServerError)})
+				_ = WriteJSON(w, http.StatusInternalServerError, NewInternalError(nil))
 			}
 		}()
 		next.ServeHTTP(w, r)
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/protomem/msg-processor/pkg/ctxstore"
+)
+
+// MessageArchiver exports messages into gzip compressed NDJSON files in a local directory,
+// one file per batch named after the export time and the ids of the batch.
+type MessageArchiver struct {
+	log *slog.Logger
+	dir string
+}
+
+func NewMessageArchiver(log *slog.Logger, dir string) (*MessageArchiver, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &MessageArchiver{
+		log: log.With("component", "messageArchiver", "dir", dir),
+		dir: dir,
+	}, nil
+}
+
+// Archive writes the messages into a new file and returns its path.
+// The file is written through a temporary file, so a failed export leaves no partial archive.
+func (a *MessageArchiver) Archive(ctx context.Context, msgs []Message) (string, error) {
+	log := a.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	if len(msgs) == 0 {
+		return "", nil
+	}
+
+	name := fmt.Sprintf(
+		"messages-%s-%d-%d.ndjson.gz",
+		time.Now().UTC().Format("20060102T150405Z"), msgs[0].ID, msgs[len(msgs)-1].ID,
+	)
+	path := filepath.Join(a.dir, name)
+	tmpPath := path + ".tmp"
+
+	if err := a.writeFile(tmpPath, msgs); err != nil {
+		log.Debug("failed to archive messages", "error", err)
+
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		log.Debug("failed to archive messages", "error", err)
+
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+
+	log.Debug("archived messages", "file", path, "countMsgs", len(msgs))
+
+	return path, nil
+}
+
+func (a *MessageArchiver) writeFile(path string, msgs []Message) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	zw := gzip.NewWriter(f)
+
+	enc := json.NewEncoder(zw)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
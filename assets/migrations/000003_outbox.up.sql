@@ -0,0 +1,14 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    sent_at    TIMESTAMPTZ,
+
+    message_id BIGINT NOT NULL REFERENCES messages (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (id) WHERE sent_at IS NULL;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP INDEX IF EXISTS messages_created_at_idx;
+DROP INDEX IF EXISTS messages_status_id_idx;
+
+COMMIT;
\ No newline at end of file
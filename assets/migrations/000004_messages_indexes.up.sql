@@ -0,0 +1,6 @@
+BEGIN;
+
+CREATE INDEX IF NOT EXISTS messages_status_id_idx ON messages (status, id);
+CREATE INDEX IF NOT EXISTS messages_created_at_idx ON messages (created_at);
+
+COMMIT;
\ No newline at end of file
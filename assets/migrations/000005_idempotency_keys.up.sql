@@ -0,0 +1,15 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT PRIMARY KEY,
+
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+    request_hash TEXT NOT NULL,
+
+    message_id      BIGINT REFERENCES messages (id) ON DELETE SET NULL,
+    response_status INTEGER,
+    response_body   BYTEA
+);
+
+COMMIT;
\ No newline at end of file
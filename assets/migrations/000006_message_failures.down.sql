@@ -0,0 +1,12 @@
+BEGIN;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS last_error;
+ALTER TABLE messages DROP COLUMN IF EXISTS attempts;
+
+UPDATE messages SET status = 'created' WHERE status IN ('failed', 'dead_letter');
+
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_status_check;
+ALTER TABLE messages ADD CONSTRAINT messages_status_check
+    CHECK (status = 'created' OR status = 'processing' OR status = 'completed');
+
+COMMIT;
\ No newline at end of file
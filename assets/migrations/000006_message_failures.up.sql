@@ -0,0 +1,10 @@
+BEGIN;
+
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_status_check;
+ALTER TABLE messages ADD CONSTRAINT messages_status_check
+    CHECK (status IN ('created', 'processing', 'completed', 'failed', 'dead_letter'));
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS attempts   INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS last_error TEXT    NOT NULL DEFAULT '';
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,23 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id BIGSERIAL PRIMARY KEY,
+
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+    message_id BIGINT REFERENCES messages (id) ON DELETE SET NULL,
+
+    source_topic     TEXT    NOT NULL,
+    source_partition INTEGER NOT NULL,
+    source_offset    BIGINT  NOT NULL,
+
+    attempts INTEGER NOT NULL,
+    error    TEXT    NOT NULL,
+
+    event_key          BYTEA,
+    event_value        BYTEA NOT NULL,
+    event_content_type TEXT  NOT NULL DEFAULT '',
+    event_headers      JSONB NOT NULL DEFAULT '{}'
+);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE IF EXISTS processing_results;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,16 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS processing_results (
+    id BIGSERIAL PRIMARY KEY,
+
+    message_id BIGINT NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+
+    processor   TEXT        NOT NULL,
+    result      JSONB       NOT NULL DEFAULT '{}',
+    duration_ns BIGINT      NOT NULL,
+    finished_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS processing_results_message_id_idx ON processing_results (message_id, id);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS routing_key;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS routing_key TEXT NOT NULL DEFAULT '';
+
+COMMIT;
\ No newline at end of file
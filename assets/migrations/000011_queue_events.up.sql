@@ -0,0 +1,19 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS queue_events (
+    id BIGSERIAL PRIMARY KEY,
+
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMPTZ,
+    deliveries   INTEGER     NOT NULL DEFAULT 0,
+
+    topic        TEXT  NOT NULL,
+    key          BYTEA,
+    value        BYTEA NOT NULL,
+    headers      JSONB NOT NULL DEFAULT '{}',
+    content_type TEXT  NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS queue_events_topic_idx ON queue_events (topic, id);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP INDEX IF EXISTS messages_status_updated_at_idx;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS reconcile_attempts;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS reconcile_attempts INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS messages_status_updated_at_idx ON messages (status, updated_at);
+
+COMMIT;
\ No newline at end of file
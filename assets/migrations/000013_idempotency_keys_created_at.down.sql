@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP INDEX IF EXISTS idempotency_keys_created_at_idx;
+
+COMMIT;
\ No newline at end of file
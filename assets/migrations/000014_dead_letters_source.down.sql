@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP INDEX IF EXISTS dead_letters_source_idx;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,12 @@
+BEGIN;
+
+DELETE FROM dead_letters d
+USING dead_letters o
+WHERE d.source_topic = o.source_topic
+    AND d.source_partition = o.source_partition
+    AND d.source_offset = o.source_offset
+    AND d.id > o.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS dead_letters_source_idx ON dead_letters (source_topic, source_partition, source_offset);
+
+COMMIT;
\ No newline at end of file
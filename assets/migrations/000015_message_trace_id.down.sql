@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS trace_id;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS trace_id TEXT NOT NULL DEFAULT '';
+
+COMMIT;
\ No newline at end of file
@@ -4,7 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/protomem/msg-processor/pkg/ctxstore"
@@ -18,16 +23,19 @@ func NewScheduler() quartz.Scheduler {
 
 func RunTaskReadProcessingMessages(
 	scheduler quartz.Scheduler, baseLog *slog.Logger,
-	store Storage, queue Queue,
-	runInterval time.Duration, runTimeout time.Duration,
+	store Storage, queue Queue, dlq *DeadLetterQueue, pool *WorkerPool, pipeline *Pipeline,
+	runInterval time.Duration, runTimeout time.Duration, maxAttempts int,
 ) error {
 	const taskName = "readProcessingMessages"
 	baseLog = baseLog.With("task", taskName)
 
-	// TODO: Commit messages after they are processed
 	task := job.NewFunctionJob(func(ctx context.Context) (struct{}, error) {
 		ctx, log := setupMetadataTask(ctx, baseLog)
 
+		// Processing and committing outlive the job on stop, so that fetched events are finished.
+		workCtx, cancelWork := context.WithTimeout(context.WithoutCancel(ctx), runTimeout)
+		defer cancelWork()
+
 		ctx, cancel := context.WithTimeout(ctx, runTimeout)
 		defer cancel()
 
@@ -42,49 +50,404 @@ func RunTaskReadProcessingMessages(
 			return struct{}{}, nil
 		}
 
-		msgsCh := make(chan Message)
+		fetchedCh := make(chan fetchedMessage)
 		go func() {
-			defer close(msgsCh)
+			defer close(fetchedCh)
 
 			ctx, cancel := context.WithTimeout(ctx, runTimeout/2)
 			defer cancel()
 
 			for {
-				evt, err := queue.ReadEvent(ctx)
+				evt, err := queue.FetchEvent(ctx)
 				if err != nil {
 					if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-						log.Error("failed to read event", "error", err)
+						log.Error("failed to fetch event", "error", err)
 					}
 					break
 				}
 
-				var msg Message
-				if err := json.Unmarshal(evt.Value, &msg); err != nil {
-					log.Error("failed to unmarshal message", "error", err)
-					break
+				fetchedCh <- parseFetchedEvent(evt)
+			}
+		}()
+
+		acks := newAckTracker(queue)
+		fetched := make([]fetchedMessage, 0)
+		for f := range fetchedCh {
+			if !acks.Track(f.evt) {
+				log.Warn("skipped event in progress", "partition", f.evt.Partition, "offset", f.evt.Offset)
+				continue
+			}
+			fetched = append(fetched, f)
+		}
+
+		log.Debug("fetched messages", "countMsgs", len(fetched))
+
+		if len(fetched) == 0 {
+			return struct{}{}, nil
+		}
+
+		processed := processMessages(workCtx, baseLog, pool, pipeline, fetched)
+
+		return struct{}{}, commitFetchedMessages(workCtx, log, store, queue, dlq, acks, fetched, processed, maxAttempts)
+	})
+
+	// A run lasts up to runTimeout, longer than runInterval, so the runs are isolated:
+	// every run acknowledges or returns all the events it fetched before the next one starts.
+	return scheduler.ScheduleJob(
+		quartz.NewJobDetail(job.NewIsolatedJob(task), quartz.NewJobKey(taskName)),
+		quartz.NewSimpleTrigger(runInterval),
+	)
+}
+
+// commitFetchedMessages finishes the processed messages and acknowledges their events
+// only after the results are committed. The fetched events must be tracked by acks.
+// An acknowledgement commits all the previous offsets of the partition, so the events after an unfinished one
+// are not acknowledged either. The unacknowledged events are returned to the queue to be delivered again,
+// so the tracker of a run does not outlive it.
+func commitFetchedMessages(
+	ctx context.Context, log *slog.Logger,
+	store Storage, queue Queue, dlq *DeadLetterQueue, acks *ackTracker,
+	fetched []fetchedMessage, processed []fetchedMessage, maxAttempts int,
+) error {
+	ackEvts := acks.Done(finishMessages(ctx, log, store, dlq, processed, maxAttempts)...)
+
+	var errs error
+	if err := queue.AckEvents(ctx, ackEvts...); err != nil {
+		log.Error("failed to ack events", "error", err)
+		errs = errors.Join(errs, err)
+		ackEvts = nil
+	}
+
+	if len(ackEvts) == len(fetched) {
+		return errs
+	}
+
+	nackEvts := make([]Event, 0, len(fetched)-len(ackEvts))
+	for _, f := range fetched {
+		if !containsEvent(ackEvts, f.evt) {
+			nackEvts = append(nackEvts, f.evt)
+		}
+	}
+
+	return errors.Join(
+		errs,
+		nackEvents(ctx, log, queue, nackEvts),
+		fmt.Errorf("failed to finish %d messages", len(nackEvts)),
+	)
+}
+
+type fetchedMessage struct {
+	evt     Event
+	msg     Message
+	results []StageResult
+	err     error
+}
+
+func parseFetchedEvent(evt Event) fetchedMessage {
+	fetched := fetchedMessage{evt: evt}
+	if fetched.msg, fetched.err = DecodeMessageEnvelope(evt.Value); fetched.err != nil {
+		// Events that can not be decoded are dead-lettered without retries.
+		fetched.msg = Message{}
+	} else if fetched.msg.ID == 0 {
+		fetched.err = errors.New("event has no message id")
+	}
+	return fetched
+}
+
+func (f fetchedMessage) processingResults() ([]ProcessingResult, error) {
+	results := make([]ProcessingResult, 0, len(f.results))
+	for _, res := range f.results {
+		output, err := json.Marshal(res.Output)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, ProcessingResult{
+			MessageID:  f.msg.ID,
+			Processor:  res.Stage,
+			Result:     output,
+			Duration:   res.Duration,
+			FinishedAt: res.FinishedAt,
+		})
+	}
+	return results, nil
+}
+
+// processMessages runs the pipeline for every parsed message on the worker pool and records the errors in fetched.
+// Every message is processed in the trace of its event.
+// It returns the messages that were processed; the rest could not be submitted and must not be acknowledged.
+func processMessages(
+	ctx context.Context, baseLog *slog.Logger,
+	pool *WorkerPool, pipeline *Pipeline,
+	fetched []fetchedMessage,
+) []fetchedMessage {
+	var wg sync.WaitGroup
+	submitted := make([]bool, len(fetched))
+	for i := range fetched {
+		f := &fetched[i]
+		if f.err != nil {
+			submitted[i] = true
+			continue
+		}
+
+		wg.Add(1)
+		if err := pool.Submit(ctx, f.evt.Key, func() {
+			defer wg.Done()
+
+			ctx, log := setupMetadataEvent(ctx, baseLog, f.evt)
+			processMessage(ctx, log, pipeline, f)
+		}); err != nil {
+			wg.Done()
+			baseLog.Warn("failed to submit message", "msgId", f.msg.ID, "error", err)
+			continue
+		}
+		submitted[i] = true
+	}
+	wg.Wait()
+
+	processed := make([]fetchedMessage, 0, len(fetched))
+	for i, f := range fetched {
+		if submitted[i] {
+			processed = append(processed, f)
+		}
+	}
+	return processed
+}
+
+func processMessage(ctx context.Context, log *slog.Logger, pipeline *Pipeline, f *fetchedMessage) {
+	if f.err != nil {
+		return
+	}
+
+	ctx = ctxstore.With(ctx, EventKey, f.evt)
+
+	results, err := pipeline.Process(ctx, f.msg)
+	if err != nil {
+		log.Warn("failed to process message", "msgId", f.msg.ID, "error", err)
+		f.err = err
+		return
+	}
+
+	log.Debug("processed message", "msgId", f.msg.ID, "countStages", len(results))
+	f.results = results
+}
+
+// finishMessages stores the outcome of the fetched messages and returns the events that can be acknowledged.
+// A message that cannot be completed is recorded as failed instead of aborting the whole batch.
+// Unparseable events and messages out of attempts are sent to the dead-letter queue.
+func finishMessages(
+	ctx context.Context, log *slog.Logger,
+	store Storage, dlq *DeadLetterQueue,
+	fetched []fetchedMessage, maxAttempts int,
+) []Event {
+	ackEvts := make([]Event, 0, len(fetched))
+
+	completed := make([]fetchedMessage, 0, len(fetched))
+	failed := make([]fetchedMessage, 0)
+	deadLettered := make([]fetchedMessage, 0)
+	deadLetters := make([]DeadLetter, 0)
+	for _, f := range fetched {
+		switch {
+		case f.msg.ID == 0:
+			// Events without a message can not be retried.
+			log.Error("failed to parse event", "error", f.err, "partition", f.evt.Partition, "offset", f.evt.Offset)
+			deadLettered = append(deadLettered, f)
+			deadLetters = append(deadLetters, dlq.NewDeadLetter(f.evt, 0, 1, f.err))
+		case f.err != nil:
+			failed = append(failed, f)
+		default:
+			completed = append(completed, f)
+		}
+	}
+
+	completedResults := make(map[uint64][]ProcessingResult, len(completed))
+	encoded := completed[:0]
+	for _, f := range completed {
+		res, err := f.processingResults()
+		if err != nil {
+			f.err = err
+			failed = append(failed, f)
+			continue
+		}
+
+		completedResults[f.msg.ID] = res
+		encoded = append(encoded, f)
+	}
+	completed = encoded
+
+	if len(completed) > 0 {
+		msgIds := make([]uint64, 0, len(completed))
+		results := make([]ProcessingResult, 0, len(completed))
+		for _, f := range completed {
+			msgIds = append(msgIds, f.msg.ID)
+			results = append(results, completedResults[f.msg.ID]...)
+		}
+
+		if err := store.CompleteMessages(ctx, msgIds, results); err == nil {
+			for _, f := range completed {
+				ackEvts = append(ackEvts, f.evt)
+			}
+		} else {
+			log.Warn("failed to complete messages, completing one by one", "error", err)
+
+			for _, f := range completed {
+				if err := store.CompleteMessages(ctx, []uint64{f.msg.ID}, completedResults[f.msg.ID]); err != nil {
+					f.err = err
+					failed = append(failed, f)
+					continue
 				}
+				ackEvts = append(ackEvts, f.evt)
+			}
+		}
+	}
 
-				msgsCh <- msg
+	if len(failed) > 0 {
+		failures := make([]MessageFailure, 0, len(failed))
+		for _, f := range failed {
+			tid := f.evt.TraceID()
+			if tid == "" {
+				tid = ctxstore.MustFrom[string](ctx, TraceIDKey)
+			}
+
+			failures = append(failures, MessageFailure{MessageID: f.msg.ID, Error: f.err.Error(), TraceID: tid})
+		}
+
+		deadLetterIds, err := store.FailMessages(ctx, failures, maxAttempts)
+		if err != nil {
+			log.Error("failed to record messages failures", "error", err)
+		} else {
+			log.Warn("failed to process messages", "countMsgs", len(failures), "countDeadLetter", len(deadLetterIds))
+
+			for _, f := range failed {
+				if !slices.Contains(deadLetterIds, f.msg.ID) {
+					ackEvts = append(ackEvts, f.evt)
+					continue
+				}
+
+				deadLettered = append(deadLettered, f)
+				deadLetters = append(deadLetters, dlq.NewDeadLetter(f.evt, f.msg.ID, maxAttempts, f.err))
+			}
+		}
+	}
+
+	if len(deadLetters) > 0 {
+		if err := dlq.Publish(ctx, deadLetters...); err != nil {
+			log.Error("failed to publish dead letters", "error", err)
+		} else {
+			for _, f := range deadLettered {
+				ackEvts = append(ackEvts, f.evt)
+			}
+		}
+	}
+
+	log.Debug(
+		"finished messages",
+		"countCompleted", len(completed), "countFailed", len(failed), "countDeadLetter", len(deadLetters),
+	)
+
+	return ackEvts
+}
+
+func RunTaskRelayOutboxEvents(
+	scheduler quartz.Scheduler, baseLog *slog.Logger,
+	store Storage, queue Queue, partitionKey PartitionKeyStrategy, metadata map[string]string,
+	runInterval time.Duration, runTimeout time.Duration, batchSize uint64,
+) error {
+	const taskName = "relayOutboxEvents"
+	baseLog = baseLog.With("task", taskName)
+
+	task := job.NewFunctionJob(func(ctx context.Context) (struct{}, error) {
+		ctx, log := setupMetadataTask(ctx, baseLog)
+
+		ctx, cancel := context.WithTimeout(ctx, runTimeout)
+		defer cancel()
+
+		log.Debug("starting")
+		defer log.Debug("finished")
+
+		count, err := store.RelayOutboxEvents(ctx, batchSize, func(ctx context.Context, outboxEvts []OutboxEvent) error {
+			evts := make([]Event, 0, len(outboxEvts))
+			for _, outboxEvt := range outboxEvts {
+				msg := outboxEvt.Message
+
+				env, err := NewMessageEnvelope(msg)
+				if err != nil {
+					return err
+				}
+
+				envJSON, err := json.Marshal(env)
+				if err != nil {
+					return err
+				}
+
+				evt := NewEvent(partitionKey.Key(msg), envJSON)
+				evt.ContentType = "application/json"
+
+				evt.Headers = maps.Clone(metadata)
+				if evt.Headers == nil {
+					evt.Headers = make(map[string]string)
+				}
+				evt.Headers[SchemaVersionHeader] = strconv.Itoa(MessageSchemaVersion)
+				if outboxEvt.TraceID != "" {
+					evt.Headers[TraceIDHeader] = outboxEvt.TraceID
+				}
+
+				evts = append(evts, evt)
 			}
-		}()
 
-		msgs := make([]Message, 0)
-		for msg := range msgsCh {
-			msgs = append(msgs, msg)
+			return queue.WriteEvents(ctx, evts...)
+		})
+		if err != nil {
+			log.Error("failed to relay outbox events", "error", err)
+			return struct{}{}, err
 		}
 
-		msgIds := make([]uint64, 0, len(msgs))
-		for _, msg := range msgs {
-			msgIds = append(msgIds, msg.ID)
+		if count > 0 {
+			log.Info("relayed outbox events", "countEvents", count)
 		}
 
-		log.Debug("processed messages", "countMsgs", len(msgs))
+		return struct{}{}, nil
+	})
+
+	return scheduler.ScheduleJob(
+		quartz.NewJobDetail(task, quartz.NewJobKey(taskName)),
+		quartz.NewSimpleTrigger(runInterval),
+	)
+}
+
+// RunTaskReconcileStuckMessages publishes again the messages stuck in created or processing for longer than stuckAfter,
+// e.g. after a crash between reading and finishing events or a lost event.
+// Messages still stuck after maxAttempts republishes are marked failed.
+func RunTaskReconcileStuckMessages(
+	scheduler quartz.Scheduler, baseLog *slog.Logger,
+	store Storage,
+	runInterval time.Duration, runTimeout time.Duration, stuckAfter time.Duration, batchSize uint64, maxAttempts int,
+) error {
+	const taskName = "reconcileStuckMessages"
+	baseLog = baseLog.With("task", taskName)
+
+	task := job.NewFunctionJob(func(ctx context.Context) (struct{}, error) {
+		ctx, log := setupMetadataTask(ctx, baseLog)
+
+		ctx, cancel := context.WithTimeout(ctx, runTimeout)
+		defer cancel()
+
+		log.Debug("starting")
+		defer log.Debug("finished")
 
-		if err := store.UpdateStatusMessages(ctx, msgIds, MessageCompleted); err != nil {
-			log.Error("failed to update messages status", "error", err)
+		republishedIds, failedIds, err := store.ReconcileStuckMessages(ctx, stuckAfter, batchSize, maxAttempts)
+		if err != nil {
+			log.Error("failed to reconcile stuck messages", "error", err)
 			return struct{}{}, err
 		}
 
+		if len(republishedIds) > 0 {
+			log.Warn("republished stuck messages", "msgIds", republishedIds)
+		}
+		if len(failedIds) > 0 {
+			log.Error("failed stuck messages", "msgIds", failedIds, "attempts", maxAttempts)
+		}
+
 		return struct{}{}, nil
 	})
 
@@ -94,9 +457,139 @@ func RunTaskReadProcessingMessages(
 	)
 }
 
+// RunTaskDeleteCompletedMessages deletes the messages completed longer than retention ago in batches of batchSize,
+// until no such messages are left or the run times out. If archiver is not nil, each batch is archived before deletion.
+func RunTaskDeleteCompletedMessages(
+	scheduler quartz.Scheduler, baseLog *slog.Logger,
+	store Storage, archiver *MessageArchiver,
+	runInterval time.Duration, runTimeout time.Duration, retention time.Duration, batchSize uint64,
+) error {
+	const taskName = "deleteCompletedMessages"
+	baseLog = baseLog.With("task", taskName)
+
+	task := job.NewFunctionJob(func(ctx context.Context) (struct{}, error) {
+		ctx, log := setupMetadataTask(ctx, baseLog)
+
+		ctx, cancel := context.WithTimeout(ctx, runTimeout)
+		defer cancel()
+
+		log.Debug("starting")
+		defer log.Debug("finished")
+
+		var countDeleted, countArchived, countFiles int64
+		defer func() {
+			metricRetentionDeletedMsgs.Add(countDeleted)
+			metricRetentionArchivedMsgs.Add(countArchived)
+			metricRetentionArchiveFiles.Add(countFiles)
+
+			if countDeleted > 0 || countArchived > 0 {
+				log.Info("deleted completed messages",
+					"countDeleted", countDeleted, "countArchived", countArchived, "countFiles", countFiles)
+			}
+		}()
+
+		for {
+			count, err := store.DeleteCompletedMessages(ctx, retention, batchSize, func(ctx context.Context, msgs []Message) error {
+				if archiver == nil {
+					return nil
+				}
+
+				if _, err := archiver.Archive(ctx, msgs); err != nil {
+					return err
+				}
+				countArchived += int64(len(msgs))
+				countFiles++
+
+				return nil
+			})
+			if err != nil {
+				metricRetentionFailedRuns.Add(1)
+				log.Error("failed to delete completed messages", "error", err)
+				return struct{}{}, err
+			}
+			countDeleted += int64(count)
+
+			if count < batchSize {
+				return struct{}{}, nil
+			}
+		}
+	})
+
+	return scheduler.ScheduleJob(
+		quartz.NewJobDetail(task, quartz.NewJobKey(taskName)),
+		quartz.NewSimpleTrigger(runInterval),
+	)
+}
+
+// RunTaskDeleteExpiredIdempotencyKeys deletes the idempotency keys saved longer than ttl ago in batches of batchSize,
+// until no such keys are left or the run times out.
+func RunTaskDeleteExpiredIdempotencyKeys(
+	scheduler quartz.Scheduler, baseLog *slog.Logger,
+	store Storage,
+	runInterval time.Duration, runTimeout time.Duration, ttl time.Duration, batchSize uint64,
+) error {
+	const taskName = "deleteExpiredIdempotencyKeys"
+	baseLog = baseLog.With("task", taskName)
+
+	task := job.NewFunctionJob(func(ctx context.Context) (struct{}, error) {
+		ctx, log := setupMetadataTask(ctx, baseLog)
+
+		ctx, cancel := context.WithTimeout(ctx, runTimeout)
+		defer cancel()
+
+		log.Debug("starting")
+		defer log.Debug("finished")
+
+		var countDeleted uint64
+		defer func() {
+			if countDeleted > 0 {
+				log.Info("deleted expired idempotency keys", "countDeleted", countDeleted)
+			}
+		}()
+
+		for {
+			count, err := store.DeleteExpiredIdempotencyKeys(ctx, ttl, batchSize)
+			if err != nil {
+				log.Error("failed to delete expired idempotency keys", "error", err)
+				return struct{}{}, err
+			}
+			countDeleted += count
+
+			if count < batchSize {
+				return struct{}{}, nil
+			}
+		}
+	})
+
+	return scheduler.ScheduleJob(
+		quartz.NewJobDetail(task, quartz.NewJobKey(taskName)),
+		quartz.NewSimpleTrigger(runInterval),
+	)
+}
+
+func nackEvents(ctx context.Context, log *slog.Logger, queue Queue, evts []Event) error {
+	if err := queue.NackEvents(ctx, evts...); err != nil {
+		log.Error("failed to nack events", "error", err)
+		return err
+	}
+	return nil
+}
+
 func setupMetadataTask(baseCtx context.Context, baseLog *slog.Logger) (ctx context.Context, log *slog.Logger) {
 	tid := genTraceID()
 	ctx = ctxstore.With(baseCtx, TraceIDKey, tid)
 	log = baseLog.With(TraceIDKey.String(), tid)
 	return
 }
+
+// setupMetadataEvent continues the trace of the request that produced the event.
+func setupMetadataEvent(baseCtx context.Context, baseLog *slog.Logger, evt Event) (ctx context.Context, log *slog.Logger) {
+	tid := evt.TraceID()
+	if tid == "" {
+		return setupMetadataTask(baseCtx, baseLog)
+	}
+
+	ctx = ctxstore.With(baseCtx, TraceIDKey, tid)
+	log = baseLog.With(TraceIDKey.String(), tid)
+	return
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingStorage fails to finish the messages with ids in failIds.
+type failingStorage struct {
+	*MemoryStorage
+	failIds map[uint64]bool
+}
+
+func (s *failingStorage) CompleteMessages(ctx context.Context, ids []uint64, results []ProcessingResult) error {
+	for _, id := range ids {
+		if s.failIds[id] {
+			return errors.New("storage is unavailable")
+		}
+	}
+	return s.MemoryStorage.CompleteMessages(ctx, ids, results)
+}
+
+func (s *failingStorage) FailMessages(ctx context.Context, failures []MessageFailure, maxAttempts int) ([]uint64, error) {
+	for _, failure := range failures {
+		if s.failIds[failure.MessageID] {
+			return nil, errors.New("storage is unavailable")
+		}
+	}
+	return s.MemoryStorage.FailMessages(ctx, failures, maxAttempts)
+}
+
+func TestCommitFetchedMessagesRedeliversUnfinished(t *testing.T) {
+	ctx := newTestContext(t)
+	log := newTestLogger()
+
+	memStore, _ := NewMemoryStorage(ctx, log)
+	store := &failingStorage{MemoryStorage: memStore, failIds: map[uint64]bool{}}
+
+	queue, _ := NewMemoryQueue(ctx, log, MemoryQueueOptions{Topic: "messages", Partitions: 1, Group: "test"})
+	dlqQueue, _ := NewMemoryQueue(ctx, log, MemoryQueueOptions{Topic: "messages.dlq", Partitions: 1, Group: "test"})
+	dlq := NewDeadLetterQueue(log, store, dlqQueue, "messages")
+
+	pool := NewWorkerPool(log, WorkerPoolOptions{Workers: 2, MaxInFlight: 10})
+	pipeline := NewPipeline()
+
+	msgs, err := store.SaveMessages(ctx, []SaveMessageDTO{{Text: "first"}, {Text: "second"}, {Text: "third"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		env, err := NewMessageEnvelope(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := json.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := queue.WriteEvents(ctx, NewEvent(nil, value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// runOnce fetches the pending events and commits them like a run of the scheduled task.
+	runOnce := func() ([]uint64, error) {
+		acks := newAckTracker(queue)
+		fetched := make([]fetchedMessage, 0)
+		for {
+			fetchCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			evt, err := queue.FetchEvent(fetchCtx)
+			cancel()
+			if errors.Is(err, context.DeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			acks.Track(evt)
+			fetched = append(fetched, parseFetchedEvent(evt))
+		}
+
+		ids := make([]uint64, 0, len(fetched))
+		for _, f := range fetched {
+			ids = append(ids, f.msg.ID)
+		}
+
+		processed := processMessages(ctx, log, pool, pipeline, fetched)
+		return ids, commitFetchedMessages(ctx, log, store, queue, dlq, acks, fetched, processed, 3)
+	}
+
+	store.failIds[msgs[1].ID] = true
+
+	ids, err := runOnce()
+	if err == nil {
+		t.Fatal("expected an error for the unfinished message")
+	}
+	if len(ids) != 3 {
+		t.Fatalf("fetched %v, want all 3 messages", ids)
+	}
+
+	store.failIds = map[uint64]bool{}
+
+	// The failed event and the events after it are delivered again.
+	ids, err = runOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{msgs[1].ID, msgs[2].ID}; !equalIds(ids, want) {
+		t.Fatalf("redelivered %v, want %v", ids, want)
+	}
+
+	ids, err = runOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("redelivered %v after all messages were finished", ids)
+	}
+
+	for _, msg := range msgs {
+		got, err := store.GetMessage(ctx, msg.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != MessageCompleted {
+			t.Errorf("message %d is %s, want %s", msg.ID, got.Status, MessageCompleted)
+		}
+	}
+}
+
+func equalIds(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	ConsumerModeScheduled = "scheduled"
+	ConsumerModeStreaming = "streaming"
+)
+
+type StreamConsumerOptions struct {
+	FlushSize     int
+	FlushInterval time.Duration
+	MaxAttempts   int
+}
+
+// StreamConsumer continuously fetches events from the queue, processes them on the worker pool
+// and stores the outcome in micro-batches, flushed by size or by time.
+type StreamConsumer struct {
+	opts StreamConsumerOptions
+	log  *slog.Logger
+
+	store    Storage
+	queue    Queue
+	dlq      *DeadLetterQueue
+	pool     *WorkerPool
+	pipeline *Pipeline
+
+	acks *ackTracker
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewStreamConsumer(
+	log *slog.Logger,
+	store Storage, queue Queue, dlq *DeadLetterQueue, pool *WorkerPool, pipeline *Pipeline,
+	opts StreamConsumerOptions,
+) *StreamConsumer {
+	opts.FlushSize = max(opts.FlushSize, 1)
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+
+	return &StreamConsumer{
+		opts: opts,
+		log:  log.With("component", "streamConsumer"),
+
+		store:    store,
+		queue:    queue,
+		dlq:      dlq,
+		pool:     pool,
+		pipeline: pipeline,
+
+		acks: newAckTracker(queue),
+
+		done: make(chan struct{}),
+	}
+}
+
+func (c *StreamConsumer) Start(ctx context.Context) {
+	// Processing and flushing outlive the fetch loop, so that fetched events are finished on stop.
+	workCtx := context.WithoutCancel(ctx)
+	ctx, c.cancel = context.WithCancel(ctx)
+
+	processedCh := make(chan fetchedMessage, c.pool.Workers())
+
+	go func() {
+		defer close(processedCh)
+		c.fetch(ctx, workCtx, processedCh)
+	}()
+
+	go func() {
+		defer close(c.done)
+		c.flush(workCtx, processedCh)
+	}()
+
+	c.log.Info("started", "flushSize", c.opts.FlushSize, "flushInterval", c.opts.FlushInterval)
+}
+
+// Stop stops fetching new events and waits until the fetched ones are finished.
+func (c *StreamConsumer) Stop(ctx context.Context) error {
+	if c.cancel == nil {
+		return nil
+	}
+	c.cancel()
+
+	select {
+	case <-c.done:
+		c.log.Info("stopped")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetch submits the fetched events to the worker pool until ctx is canceled
+// and waits for the submitted ones to be processed.
+func (c *StreamConsumer) fetch(ctx, workCtx context.Context, processedCh chan<- fetchedMessage) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, log := setupMetadataTask(ctx, c.log)
+
+	for {
+		evt, err := c.queue.FetchEvent(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrQueueClosed) {
+				return
+			}
+
+			log.Error("failed to fetch event", "error", err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		if !c.acks.Track(evt) {
+			log.Warn("skipped event in progress", "partition", evt.Partition, "offset", evt.Offset)
+			continue
+		}
+		f := parseFetchedEvent(evt)
+
+		wg.Add(1)
+		if err := c.pool.Submit(ctx, evt.Key, func() {
+			defer wg.Done()
+
+			ctx, log := setupMetadataEvent(workCtx, c.log, evt)
+			processMessage(ctx, log, c.pipeline, &f)
+
+			processedCh <- f
+		}); err != nil {
+			// The event is not acknowledged and will be delivered again.
+			wg.Done()
+			if ctx.Err() == nil {
+				log.Error("failed to submit message", "error", err)
+			}
+			return
+		}
+	}
+}
+
+func (c *StreamConsumer) flush(ctx context.Context, processedCh <-chan fetchedMessage) {
+	ticker := time.NewTicker(c.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]fetchedMessage, 0, c.opts.FlushSize)
+	for {
+		select {
+		case f, ok := <-processedCh:
+			if !ok {
+				c.flushBatch(ctx, batch)
+				return
+			}
+
+			batch = append(batch, f)
+			if len(batch) >= c.opts.FlushSize {
+				batch = c.flushBatch(ctx, batch)
+			}
+		case <-ticker.C:
+			batch = c.flushBatch(ctx, batch)
+		}
+	}
+}
+
+// flushBatch stores the outcome of the batch and acknowledges the events that are safe to acknowledge.
+// Messages that can not be finished are kept in the returned batch and retried on the next flush.
+func (c *StreamConsumer) flushBatch(ctx context.Context, batch []fetchedMessage) []fetchedMessage {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	ctx, log := setupMetadataTask(ctx, c.log)
+
+	finished := finishMessages(ctx, log, c.store, c.dlq, batch, c.opts.MaxAttempts)
+
+	ackEvts := c.acks.Done(finished...)
+	if err := c.queue.AckEvents(ctx, ackEvts...); err != nil {
+		log.Error("failed to ack events", "error", err)
+	}
+
+	log.Debug("flushed messages", "countMsgs", len(batch), "countFinished", len(finished), "countAcked", len(ackEvts))
+
+	pending := batch[:0]
+	for _, f := range batch {
+		if !containsEvent(finished, f.evt) {
+			pending = append(pending, f)
+		}
+	}
+	return pending
+}
+
+func containsEvent(evts []Event, evt Event) bool {
+	for _, e := range evts {
+		if e.Partition == evt.Partition && e.Offset == evt.Offset {
+			return true
+		}
+	}
+	return false
+}
+
+// ackTracker keeps the fetched events in order per partition.
+// Acknowledging an offset commits everything before it, so an event is acknowledged
+// only when all events fetched before it from the same partition are finished.
+// Events of queues that acknowledge every event on its own are acknowledged as soon as they are finished.
+type ackTracker struct {
+	mu         sync.Mutex
+	individual bool
+	partitions map[int]*trackedPartition
+}
+
+type trackedPartition struct {
+	evts []Event
+	// finished holds the offsets of the tracked events.
+	finished map[int64]bool
+}
+
+func newAckTracker(queue Queue) *ackTracker {
+	_, individual := queue.(individualAcker)
+
+	return &ackTracker{
+		individual: individual,
+		partitions: make(map[int]*trackedPartition),
+	}
+}
+
+// Track starts tracking the fetched event.
+// It returns false if the event is already tracked, e.g. delivered again while it is still processed.
+func (t *ackTracker) Track(evt Event) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[evt.Partition]
+	if !ok {
+		p = &trackedPartition{finished: make(map[int64]bool)}
+		t.partitions[evt.Partition] = p
+	}
+
+	if _, ok := p.finished[evt.Offset]; ok {
+		return false
+	}
+
+	p.finished[evt.Offset] = false
+	p.evts = append(p.evts, evt)
+	return true
+}
+
+// Done marks the events as finished and returns the events that can be acknowledged.
+func (t *ackTracker) Done(evts ...Event) []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	touched := make(map[int]struct{})
+	for _, evt := range evts {
+		p, ok := t.partitions[evt.Partition]
+		if !ok {
+			continue
+		}
+		if _, ok := p.finished[evt.Offset]; !ok {
+			continue
+		}
+
+		p.finished[evt.Offset] = true
+		touched[evt.Partition] = struct{}{}
+	}
+
+	ackEvts := make([]Event, 0, len(evts))
+	for partition := range touched {
+		p := t.partitions[partition]
+
+		if t.individual {
+			pending := p.evts[:0]
+			for _, evt := range p.evts {
+				if !p.finished[evt.Offset] {
+					pending = append(pending, evt)
+					continue
+				}
+
+				delete(p.finished, evt.Offset)
+				ackEvts = append(ackEvts, evt)
+			}
+			p.evts = pending
+			continue
+		}
+
+		n := 0
+		for n < len(p.evts) && p.finished[p.evts[n].Offset] {
+			delete(p.finished, p.evts[n].Offset)
+			n++
+		}
+
+		ackEvts = append(ackEvts, p.evts[:n]...)
+		p.evts = p.evts[n:]
+	}
+
+	return ackEvts
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestAckTrackerDoneAcknowledgesFinishedPrefix(t *testing.T) {
+	acks := newAckTracker(newTestMemoryQueue(t, 2))
+
+	evts := []Event{
+		{Partition: 0, Offset: 1},
+		{Partition: 0, Offset: 2},
+		{Partition: 0, Offset: 3},
+		{Partition: 1, Offset: 1},
+	}
+	for _, evt := range evts {
+		acks.Track(evt)
+	}
+
+	// The later events of partition 0 wait for the first one, partition 1 does not.
+	got := acks.Done(evts[1], evts[2], evts[3])
+	if len(got) != 1 || !containsEvent(got, evts[3]) {
+		t.Fatalf("got %+v, want only the event of partition 1", got)
+	}
+
+	got = acks.Done(evts[0])
+	if len(got) != 3 || !containsEvent(got, evts[0]) || !containsEvent(got, evts[1]) || !containsEvent(got, evts[2]) {
+		t.Fatalf("got %+v, want the whole partition 0", got)
+	}
+
+	if got := acks.Done(evts[0]); len(got) != 0 {
+		t.Fatalf("got %+v for an acknowledged event", got)
+	}
+}
+
+func TestAckTrackerDoneAcknowledgesIndividualEvents(t *testing.T) {
+	acks := newAckTracker(&PgQueue{})
+
+	evts := []Event{{Offset: 1}, {Offset: 2}, {Offset: 3}}
+	for _, evt := range evts {
+		acks.Track(evt)
+	}
+
+	got := acks.Done(evts[1])
+	if len(got) != 1 || !containsEvent(got, evts[1]) {
+		t.Fatalf("got %+v, want the finished event without waiting for the previous one", got)
+	}
+
+	got = acks.Done(evts[0], evts[2])
+	if len(got) != 2 || !containsEvent(got, evts[0]) || !containsEvent(got, evts[2]) {
+		t.Fatalf("got %+v, want the rest of the events", got)
+	}
+}
+
+func TestAckTrackerTrackSkipsTrackedEvents(t *testing.T) {
+	acks := newAckTracker(newTestMemoryQueue(t, 1))
+
+	evt := Event{Offset: 1}
+	if !acks.Track(evt) {
+		t.Fatal("the new event is not tracked")
+	}
+	if acks.Track(evt) {
+		t.Fatal("the event delivered again is tracked twice")
+	}
+
+	if got := acks.Done(evt); len(got) != 1 {
+		t.Fatalf("got %+v, want the event acknowledged once", got)
+	}
+
+	// An acknowledged event delivered again is tracked anew.
+	if !acks.Track(evt) {
+		t.Fatal("the acknowledged event is not tracked again")
+	}
+}
@@ -5,4 +5,7 @@ import "github.com/protomem/msg-processor/pkg/ctxstore"
 const (
 	TraceIDKey = ctxstore.Key("traceId")
 	HandlerKey = ctxstore.Key("handler")
+
+	// EventKey holds the queue event of the processed message.
+	EventKey = ctxstore.Key("event")
 )
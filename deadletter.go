@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"maps"
+	"strconv"
+	"time"
+
+	"github.com/protomem/msg-processor/pkg/ctxstore"
+)
+
+const (
+	DeadLetterErrorHeader     = "dlq-error"
+	DeadLetterTopicHeader     = "dlq-source-topic"
+	DeadLetterPartitionHeader = "dlq-source-partition"
+	DeadLetterOffsetHeader    = "dlq-source-offset"
+	DeadLetterAttemptsHeader  = "dlq-attempts"
+	DeadLetterFailedAtHeader  = "dlq-failed-at"
+)
+
+// DeadLetterQueue publishes events that can not be processed to the dead-letter queue
+// and keeps a copy of them in the storage for inspection.
+type DeadLetterQueue struct {
+	log   *slog.Logger
+	store Storage
+	queue Queue
+
+	sourceTopic string
+}
+
+func NewDeadLetterQueue(log *slog.Logger, store Storage, queue Queue, sourceTopic string) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		log:   log.With("component", "deadLetterQueue"),
+		store: store,
+		queue: queue,
+
+		sourceTopic: sourceTopic,
+	}
+}
+
+func (q *DeadLetterQueue) NewDeadLetter(evt Event, msgID uint64, attempts int, cause error) DeadLetter {
+	sourceTopic := evt.Topic
+	if sourceTopic == "" {
+		sourceTopic = q.sourceTopic
+	}
+
+	return DeadLetter{
+		MessageID: msgID,
+
+		SourceTopic:     sourceTopic,
+		SourcePartition: evt.Partition,
+		SourceOffset:    evt.Offset,
+
+		Attempts: attempts,
+		Error:    cause.Error(),
+
+		Key:         bytes.Clone(evt.Key),
+		Value:       bytes.Clone(evt.Value),
+		ContentType: evt.ContentType,
+		Headers:     maps.Clone(evt.Headers),
+	}
+}
+
+func (q *DeadLetterQueue) Publish(ctx context.Context, letters ...DeadLetter) error {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	if len(letters) == 0 {
+		return nil
+	}
+
+	failedAt := time.Now()
+
+	evts := make([]Event, 0, len(letters))
+	for _, letter := range letters {
+		evt := NewEvent(letter.Key, letter.Value)
+		evt.ContentType = letter.ContentType
+
+		evt.Headers = maps.Clone(letter.Headers)
+		if evt.Headers == nil {
+			evt.Headers = make(map[string]string)
+		}
+		evt.Headers[DeadLetterErrorHeader] = letter.Error
+		evt.Headers[DeadLetterTopicHeader] = letter.SourceTopic
+		evt.Headers[DeadLetterPartitionHeader] = strconv.Itoa(letter.SourcePartition)
+		evt.Headers[DeadLetterOffsetHeader] = strconv.FormatInt(letter.SourceOffset, 10)
+		evt.Headers[DeadLetterAttemptsHeader] = strconv.Itoa(letter.Attempts)
+		evt.Headers[DeadLetterFailedAtHeader] = failedAt.Format(time.RFC3339Nano)
+
+		evts = append(evts, evt)
+	}
+
+	// The letters are saved first: if the write fails, the source events are delivered again
+	// and the retry publishes the letters once more, while saving them again is skipped by the storage.
+	if err := q.store.SaveDeadLetters(ctx, letters); err != nil {
+		log.Debug("failed to save dead letters", "error", err)
+
+		return err
+	}
+
+	if err := q.queue.WriteEvents(ctx, evts...); err != nil {
+		log.Debug("failed to publish dead letters", "error", err)
+
+		return err
+	}
+
+	log.Warn("published dead letters", "countDeadLetters", len(letters))
+
+	return nil
+}
+
+func (q *DeadLetterQueue) Close(ctx context.Context) error {
+	return q.queue.Close(ctx)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDeadLetterQueuePublish(t *testing.T) {
+	ctx := newTestContext(t)
+	store := newTestMemoryStorage(t)
+	queue := newTestMemoryQueue(t, 1)
+	dlq := NewDeadLetterQueue(newTestLogger(), store, queue, "messages")
+
+	evt := NewEvent([]byte("key"), []byte{0xff, 0xfe})
+	evt.ContentType = "application/octet-stream"
+	evt.Offset = 7
+
+	if err := dlq.Publish(ctx, dlq.NewDeadLetter(evt, 0, 1, errors.New("bad event"))); err != nil {
+		t.Fatal(err)
+	}
+
+	published, err := queue.FetchEvent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(published.Value, evt.Value) || published.ContentType != evt.ContentType {
+		t.Fatalf("got %+v, want the value and content type of %+v", published, evt)
+	}
+	if published.Headers[DeadLetterErrorHeader] != "bad event" || published.Headers[DeadLetterOffsetHeader] != "7" {
+		t.Fatalf("got headers %v", published.Headers)
+	}
+
+	letters, err := store.ListDeadLetters(ctx, ListDeadLettersDTO{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || !bytes.Equal(letters[0].Value, evt.Value) || letters[0].ContentType != evt.ContentType {
+		t.Fatalf("got %+v, want the saved dead letter", letters)
+	}
+}
+
+func TestDeadLetterQueueSavesBeforePublish(t *testing.T) {
+	ctx := newTestContext(t)
+	store := newTestMemoryStorage(t)
+	queue := newTestMemoryQueue(t, 1)
+	dlq := NewDeadLetterQueue(newTestLogger(), store, queue, "messages")
+
+	if err := queue.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	letter := dlq.NewDeadLetter(NewEvent(nil, []byte("one")), 0, 1, errors.New("bad event"))
+	if err := dlq.Publish(ctx, letter); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("got %v, want %v", err, ErrQueueClosed)
+	}
+
+	letters, err := store.ListDeadLetters(ctx, ListDeadLettersDTO{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("got %d dead letters, want the letter saved before the failed write", len(letters))
+	}
+}
@@ -15,6 +15,57 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/dlq": {
+            "get": {
+                "description": "List events sent to the dead-letter queue with keyset pagination by id",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "dlq"
+                ],
+                "summary": "List dead letters",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cursor from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "maximum": 100,
+                        "type": "integer",
+                        "default": 20,
+                        "description": "Page size",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.DeadLetterListDTO"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    }
+                }
+            }
+        },
         "/msg": {
             "get": {
                 "description": "Message statistics",
@@ -38,7 +89,7 @@ const docTemplate = `{
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
-                            "type": "object"
+                            "$ref": "#/definitions/main.APIError"
                         }
                     }
                 }
@@ -64,6 +115,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/main.SaveMessageDTO"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key to safely retry the request",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -73,10 +130,245 @@ const docTemplate = `{
                             "$ref": "#/definitions/main.Message"
                         }
                     },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    },
+                    "409": {
+                        "description": "Idempotency key is used with another request or in progress",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    }
+                }
+            }
+        },
+        "/msg/batch": {
+            "post": {
+                "description": "Save a batch of messages as a JSON array or as NDJSON (application/x-ndjson).\nInvalid items are reported in the results, valid items are saved in one transaction.",
+                "consumes": [
+                    "application/json",
+                    "application/x-ndjson"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "message"
+                ],
+                "summary": "Save messages",
+                "parameters": [
+                    {
+                        "description": "Messages",
+                        "name": "messages",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.SaveMessageDTO"
+                            }
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "All messages are saved",
+                        "schema": {
+                            "$ref": "#/definitions/main.SaveMessagesResultDTO"
+                        }
+                    },
+                    "207": {
+                        "description": "Some messages are not saved",
+                        "schema": {
+                            "$ref": "#/definitions/main.SaveMessagesResultDTO"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    }
+                }
+            }
+        },
+        "/msg/{id}": {
+            "get": {
+                "description": "Get message by id with its processing results",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "message"
+                ],
+                "summary": "Get message",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Message ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.MessageDetailsDTO"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    }
+                }
+            }
+        },
+        "/msgs": {
+            "get": {
+                "description": "List messages with keyset pagination by id",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "message"
+                ],
+                "summary": "List messages",
+                "parameters": [
+                    {
+                        "enum": [
+                            "created",
+                            "processing",
+                            "completed",
+                            "failed",
+                            "dead_letter"
+                        ],
+                        "type": "string",
+                        "description": "Message status",
+                        "name": "status",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Created at or after (RFC3339)",
+                        "name": "createdFrom",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Created before (RFC3339)",
+                        "name": "createdTo",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Text substring (case insensitive)",
+                        "name": "text",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "asc",
+                            "desc"
+                        ],
+                        "type": "string",
+                        "default": "asc",
+                        "description": "Sort order by id",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "maximum": 100,
+                        "type": "integer",
+                        "default": 20,
+                        "description": "Page size",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.MessageListDTO"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/main.APIError"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
-                            "type": "object"
+                            "$ref": "#/definitions/main.APIError"
                         }
                     }
                 }
@@ -84,15 +376,168 @@ const docTemplate = `{
         }
     },
     "definitions": {
+        "main.APIError": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "$ref": "#/definitions/main.APIErrorCode"
+                },
+                "fields": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.FieldError"
+                    }
+                },
+                "message": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.APIErrorCode": {
+            "type": "string",
+            "enum": [
+                "validation",
+                "too_large",
+                "not_found",
+                "conflict",
+                "unavailable",
+                "internal"
+            ],
+            "x-enum-varnames": [
+                "APICodeValidation",
+                "APICodeTooLarge",
+                "APICodeNotFound",
+                "APICodeConflict",
+                "APICodeUnavailable",
+                "APICodeInternal"
+            ]
+        },
+        "main.DeadLetter": {
+            "type": "object",
+            "properties": {
+                "attempts": {
+                    "type": "integer"
+                },
+                "contentType": {
+                    "type": "string"
+                },
+                "createdAt": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "headers": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "key": {
+                    "description": "Key and Value are the raw bytes of the event, encoded as base64 in JSON.",
+                    "type": "string",
+                    "format": "base64"
+                },
+                "messageId": {
+                    "description": "Zero if the event can not be parsed into a message.",
+                    "type": "integer"
+                },
+                "sourceOffset": {
+                    "type": "integer"
+                },
+                "sourcePartition": {
+                    "type": "integer"
+                },
+                "sourceTopic": {
+                    "type": "string"
+                },
+                "value": {
+                    "type": "string",
+                    "format": "base64"
+                }
+            }
+        },
+        "main.DeadLetterListDTO": {
+            "type": "object",
+            "properties": {
+                "deadLetters": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.DeadLetter"
+                    }
+                },
+                "nextCursor": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.FieldError": {
+            "type": "object",
+            "properties": {
+                "field": {
+                    "type": "string"
+                },
+                "message": {
+                    "type": "string"
+                }
+            }
+        },
         "main.Message": {
             "type": "object",
             "properties": {
+                "attempts": {
+                    "type": "integer"
+                },
+                "createdAt": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "lastError": {
+                    "type": "string"
+                },
+                "routingKey": {
+                    "type": "string"
+                },
+                "status": {
+                    "$ref": "#/definitions/main.MessageStatus"
+                },
+                "text": {
+                    "type": "string"
+                },
+                "updatedAt": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.MessageDetailsDTO": {
+            "type": "object",
+            "properties": {
+                "attempts": {
+                    "type": "integer"
+                },
                 "createdAt": {
                     "type": "string"
                 },
                 "id": {
                     "type": "integer"
                 },
+                "lastError": {
+                    "type": "string"
+                },
+                "results": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.ProcessingResult"
+                    }
+                },
+                "routingKey": {
+                    "type": "string"
+                },
                 "status": {
                     "$ref": "#/definitions/main.MessageStatus"
                 },
@@ -104,12 +549,32 @@ const docTemplate = `{
                 }
             }
         },
+        "main.MessageListDTO": {
+            "type": "object",
+            "properties": {
+                "messages": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Message"
+                    }
+                },
+                "nextCursor": {
+                    "type": "string"
+                }
+            }
+        },
         "main.MessageStatisticsDTO": {
             "type": "object",
             "properties": {
                 "completed": {
                     "type": "integer"
                 },
+                "deadLetter": {
+                    "type": "integer"
+                },
+                "failed": {
+                    "type": "integer"
+                },
                 "processing": {
                     "type": "integer"
                 }
@@ -120,19 +585,81 @@ const docTemplate = `{
             "enum": [
                 "created",
                 "processing",
-                "completed"
+                "completed",
+                "failed",
+                "dead_letter"
             ],
             "x-enum-varnames": [
                 "MessageCreated",
                 "MessageProcessing",
-                "MessageCompleted"
+                "MessageCompleted",
+                "MessageFailed",
+                "MessageDeadLetter"
             ]
         },
+        "main.ProcessingResult": {
+            "type": "object",
+            "properties": {
+                "durationNs": {
+                    "type": "integer"
+                },
+                "finishedAt": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "messageId": {
+                    "type": "integer"
+                },
+                "processor": {
+                    "type": "string"
+                },
+                "result": {
+                    "type": "object"
+                }
+            }
+        },
         "main.SaveMessageDTO": {
             "type": "object",
             "properties": {
                 "message": {
                     "type": "string"
+                },
+                "routingKey": {
+                    "description": "RoutingKey selects the queue partition of the message, messages with the same key are processed in order.",
+                    "type": "string"
+                }
+            }
+        },
+        "main.SaveMessageResultDTO": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "$ref": "#/definitions/main.APIError"
+                },
+                "index": {
+                    "type": "integer"
+                },
+                "message": {
+                    "$ref": "#/definitions/main.Message"
+                }
+            }
+        },
+        "main.SaveMessagesResultDTO": {
+            "type": "object",
+            "properties": {
+                "failed": {
+                    "type": "integer"
+                },
+                "results": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.SaveMessageResultDTO"
+                    }
+                },
+                "succeeded": {
+                    "type": "integer"
                 }
             }
         }
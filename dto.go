@@ -1,10 +1,67 @@
 package main
 
+import "time"
+
 type SaveMessageDTO struct {
 	Text string `json:"message"`
+
+	// RoutingKey selects the queue partition of the message, messages with the same key are processed in order.
+	RoutingKey string `json:"routingKey,omitempty"`
+}
+
+type SaveMessageResultDTO struct {
+	Index   int       `json:"index"`
+	Message *Message  `json:"message,omitempty"`
+	Error   *APIError `json:"error,omitempty"`
+}
+
+type SaveMessagesResultDTO struct {
+	Succeeded int                    `json:"succeeded"`
+	Failed    int                    `json:"failed"`
+	Results   []SaveMessageResultDTO `json:"results"`
+}
+
+type MessageDetailsDTO struct {
+	Message
+	Results []ProcessingResult `json:"results"`
 }
 
 type MessageStatisticsDTO struct {
 	Processing uint64 `json:"processing"`
 	Completed  uint64 `json:"completed"`
+	Failed     uint64 `json:"failed"`
+	DeadLetter uint64 `json:"deadLetter"`
+}
+
+type SortOrder string
+
+const (
+	SortAsc  SortOrder = "asc"
+	SortDesc SortOrder = "desc"
+)
+
+type ListMessagesDTO struct {
+	Status      MessageStatus
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	Text        string
+
+	Order  SortOrder
+	Cursor uint64
+	Limit  uint64
+}
+
+type MessageListDTO struct {
+	Messages   []Message `json:"messages"`
+	NextCursor string    `json:"nextCursor,omitempty"`
+}
+
+type ListDeadLettersDTO struct {
+	Cursor uint64
+	Limit  uint64
+}
+
+type DeadLetterListDTO struct {
+	DeadLetters []DeadLetter `json:"deadLetters"`
+	NextCursor  string       `json:"nextCursor,omitempty"`
 }
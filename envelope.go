@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	MessageCreatedEventType = "message.created"
+
+	// MessageSchemaVersion is the version of the envelope payload produced by the service.
+	//
+	// Versions:
+	//   - 1: the raw Message without an envelope.
+	//   - 2: the envelope with MessageCreatedPayload.
+	MessageSchemaVersion = 2
+)
+
+var (
+	ErrUnknownEventType     = errors.New("unknown event type")
+	ErrUnknownSchemaVersion = errors.New("unknown schema version")
+	ErrInvalidEventEnvelope = errors.New("invalid event envelope")
+)
+
+// Envelope wraps the payload of an event with the information needed to decode it.
+type Envelope struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	SchemaVersion int             `json:"schemaVersion"`
+	ProducedAt    time.Time       `json:"producedAt"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+type MessageCreatedPayload struct {
+	ID         uint64    `json:"id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Text       string    `json:"text"`
+	RoutingKey string    `json:"routingKey,omitempty"`
+}
+
+// Upcaster converts the payload of a schema version into the next version.
+type Upcaster func(payload json.RawMessage) (json.RawMessage, error)
+
+// messageUpcasters are keyed by the version they convert from.
+var messageUpcasters = map[int]Upcaster{
+	1: upcastMessageV1,
+}
+
+func NewMessageEnvelope(msg Message) (Envelope, error) {
+	payload, err := json.Marshal(MessageCreatedPayload{
+		ID:         msg.ID,
+		CreatedAt:  msg.CreatedAt,
+		Text:       msg.Text,
+		RoutingKey: msg.RoutingKey,
+	})
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		ID:            uuid.NewString(),
+		Type:          MessageCreatedEventType,
+		SchemaVersion: MessageSchemaVersion,
+		ProducedAt:    time.Now(),
+		Payload:       payload,
+	}, nil
+}
+
+// DecodeMessageEnvelope decodes the message from the event value, upcasting older schema versions.
+// Values without an envelope are decoded as the first version.
+func DecodeMessageEnvelope(value []byte) (Message, error) {
+	var probe struct {
+		SchemaVersion *int `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(value, &probe); err != nil {
+		return Message{}, fmt.Errorf("%w: %w", ErrInvalidEventEnvelope, err)
+	}
+
+	env := Envelope{Type: MessageCreatedEventType, SchemaVersion: 1, Payload: value}
+	if probe.SchemaVersion != nil {
+		env = Envelope{}
+		if err := json.Unmarshal(value, &env); err != nil {
+			return Message{}, fmt.Errorf("%w: %w", ErrInvalidEventEnvelope, err)
+		}
+	}
+
+	if env.Type != MessageCreatedEventType {
+		return Message{}, fmt.Errorf("%w: %q", ErrUnknownEventType, env.Type)
+	}
+
+	payload, err := upcast(env.SchemaVersion, env.Payload)
+	if err != nil {
+		return Message{}, err
+	}
+
+	var msgPayload MessageCreatedPayload
+	if err := json.Unmarshal(payload, &msgPayload); err != nil {
+		return Message{}, fmt.Errorf("%w: %w", ErrInvalidEventEnvelope, err)
+	}
+
+	return Message{
+		ID:         msgPayload.ID,
+		CreatedAt:  msgPayload.CreatedAt,
+		Text:       msgPayload.Text,
+		RoutingKey: msgPayload.RoutingKey,
+		Status:     MessageProcessing,
+	}, nil
+}
+
+func upcast(version int, payload json.RawMessage) (json.RawMessage, error) {
+	if version < 1 || version > MessageSchemaVersion {
+		return nil, fmt.Errorf("%w: %d, supported up to %d", ErrUnknownSchemaVersion, version, MessageSchemaVersion)
+	}
+
+	for ; version < MessageSchemaVersion; version++ {
+		upcaster, ok := messageUpcasters[version]
+		if !ok {
+			return nil, fmt.Errorf("%w: no upcaster from %d", ErrUnknownSchemaVersion, version)
+		}
+
+		var err error
+		if payload, err = upcaster(payload); err != nil {
+			return nil, fmt.Errorf("upcast from version %d: %w", version, err)
+		}
+	}
+
+	return payload, nil
+}
+
+func upcastMessageV1(payload json.RawMessage) (json.RawMessage, error) {
+	var msg Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(MessageCreatedPayload{
+		ID:         msg.ID,
+		CreatedAt:  msg.CreatedAt,
+		Text:       msg.Text,
+		RoutingKey: msg.RoutingKey,
+	})
+}
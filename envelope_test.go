@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDecodeMessageEnvelope(t *testing.T) {
+	msg := Message{ID: 1, CreatedAt: time.Now().UTC().Truncate(time.Second), Text: "one", RoutingKey: "key"}
+
+	env, err := NewMessageEnvelope(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := DecodeMessageEnvelope(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != msg.ID || !got.CreatedAt.Equal(msg.CreatedAt) || got.Text != msg.Text ||
+		got.RoutingKey != msg.RoutingKey || got.Status != MessageProcessing {
+		t.Fatalf("got %+v, want %+v", got, msg)
+	}
+}
+
+func TestDecodeMessageEnvelopeUpcastsV1(t *testing.T) {
+	msg := Message{ID: 1, CreatedAt: time.Now().UTC().Truncate(time.Second), Text: "one", RoutingKey: "key"}
+
+	// The first version is the raw message, both bare and in an envelope.
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(Envelope{Type: MessageCreatedEventType, SchemaVersion: 1, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range [][]byte{payload, value} {
+		got, err := DecodeMessageEnvelope(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != msg.ID || !got.CreatedAt.Equal(msg.CreatedAt) || got.Text != msg.Text || got.RoutingKey != msg.RoutingKey {
+			t.Fatalf("got %+v from %s, want %+v", got, value, msg)
+		}
+	}
+}
+
+func TestDecodeMessageEnvelopeRejectsUnknown(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  error
+	}{
+		{"unknown version", `{"type":"message.created","schemaVersion":3,"payload":{}}`, ErrUnknownSchemaVersion},
+		{"zero version", `{"type":"message.created","schemaVersion":0,"payload":{}}`, ErrUnknownSchemaVersion},
+		{"unknown type", `{"type":"message.deleted","schemaVersion":2,"payload":{}}`, ErrUnknownEventType},
+		{"invalid json", `{"type":`, ErrInvalidEventEnvelope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeMessageEnvelope([]byte(tt.value)); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
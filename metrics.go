@@ -0,0 +1,11 @@
+package main
+
+import "expvar"
+
+// Metrics are published in JSON on GET /debug/vars.
+var (
+	metricRetentionDeletedMsgs  = expvar.NewInt("retentionDeletedMessages")
+	metricRetentionArchivedMsgs = expvar.NewInt("retentionArchivedMessages")
+	metricRetentionArchiveFiles = expvar.NewInt("retentionArchiveFiles")
+	metricRetentionFailedRuns   = expvar.NewInt("retentionFailedRuns")
+)
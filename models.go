@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"time"
 )
@@ -11,9 +12,24 @@ const (
 	MessageCreated    MessageStatus = "created"
 	MessageProcessing MessageStatus = "processing"
 	MessageCompleted  MessageStatus = "completed"
+	MessageFailed     MessageStatus = "failed"
+	MessageDeadLetter MessageStatus = "dead_letter"
 )
 
-var ErrMsgNotFound = errors.New("message not found")
+func (s MessageStatus) Valid() bool {
+	switch s {
+	case MessageCreated, MessageProcessing, MessageCompleted, MessageFailed, MessageDeadLetter:
+		return true
+	default:
+		return false
+	}
+}
+
+var (
+	ErrMsgNotFound  = errors.New("message not found")
+	ErrMsgEmptyText = errors.New("message text is empty")
+	ErrMsgStuck     = errors.New("message is stuck without being processed")
+)
 
 type Message struct {
 	ID uint64 `json:"id"`
@@ -21,7 +37,80 @@ type Message struct {
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
 
-	Text string `json:"text"`
+	Text       string `json:"text"`
+	RoutingKey string `json:"routingKey,omitempty"`
 
 	Status MessageStatus `json:"status"`
+
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+type MessageFailure struct {
+	MessageID uint64
+	Error     string
+
+	// TraceID is carried to the outbox event of the retry.
+	TraceID string
+}
+
+type OutboxEvent struct {
+	ID uint64
+
+	CreatedAt time.Time
+
+	// TraceID of the request that produced the event.
+	TraceID string
+
+	Message Message
+}
+
+type IdempotencyKey struct {
+	Key string
+
+	CreatedAt time.Time
+
+	RequestHash string
+
+	// Set once the request is completed.
+	MessageID      uint64
+	ResponseStatus int
+	ResponseBody   []byte
+}
+
+func (k IdempotencyKey) Completed() bool {
+	return k.ResponseStatus != 0
+}
+
+type DeadLetter struct {
+	ID uint64 `json:"id"`
+
+	CreatedAt time.Time `json:"createdAt"`
+
+	// Zero if the event can not be parsed into a message.
+	MessageID uint64 `json:"messageId,omitempty"`
+
+	SourceTopic     string `json:"sourceTopic"`
+	SourcePartition int    `json:"sourcePartition"`
+	SourceOffset    int64  `json:"sourceOffset"`
+
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+
+	// Key and Value are the raw bytes of the event, encoded as base64 in JSON.
+	Key         []byte            `json:"key" swaggertype:"string" format:"base64"`
+	Value       []byte            `json:"value" swaggertype:"string" format:"base64"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type ProcessingResult struct {
+	ID uint64 `json:"id"`
+
+	MessageID uint64 `json:"messageId"`
+
+	Processor  string          `json:"processor"`
+	Result     json.RawMessage `json:"result" swaggertype:"object"`
+	Duration   time.Duration   `json:"durationNs" swaggertype:"integer"`
+	FinishedAt time.Time       `json:"finishedAt"`
 }
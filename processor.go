@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type ProcessResult struct {
+	// Message passed to the next stage.
+	Message Message
+	Output  map[string]any
+}
+
+// Processor handles a message at one stage of the pipeline.
+// The event of the message, with its headers and position, is available in ctx by EventKey.
+type Processor interface {
+	Process(ctx context.Context, msg Message) (ProcessResult, error)
+}
+
+type ProcessorFunc func(ctx context.Context, msg Message) (ProcessResult, error)
+
+func (f ProcessorFunc) Process(ctx context.Context, msg Message) (ProcessResult, error) {
+	return f(ctx, msg)
+}
+
+type ProcessingStage struct {
+	Name      string
+	Processor Processor
+}
+
+type StageResult struct {
+	Stage      string
+	Output     map[string]any
+	Duration   time.Duration
+	FinishedAt time.Time
+}
+
+// Pipeline runs the stages one after another, passing the message returned by a stage to the next one.
+type Pipeline struct {
+	stages []ProcessingStage
+}
+
+func NewPipeline(stages ...ProcessingStage) *Pipeline {
+	return &Pipeline{stages: stages}
+}
+
+func (p *Pipeline) Stages() []string {
+	names := make([]string, 0, len(p.stages))
+	for _, stage := range p.stages {
+		names = append(names, stage.Name)
+	}
+	return names
+}
+
+// Process stops at the first failed stage and returns the results of the completed ones.
+func (p *Pipeline) Process(ctx context.Context, msg Message) ([]StageResult, error) {
+	results := make([]StageResult, 0, len(p.stages))
+	for _, stage := range p.stages {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		begin := time.Now()
+		res, err := stage.Processor.Process(ctx, msg)
+		end := time.Now()
+		if err != nil {
+			return results, fmt.Errorf("stage %q: %w", stage.Name, err)
+		}
+
+		results = append(results, StageResult{
+			Stage:      stage.Name,
+			Output:     res.Output,
+			Duration:   end.Sub(begin),
+			FinishedAt: end,
+		})
+		msg = res.Message
+	}
+
+	return results, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/protomem/msg-processor/pkg/ctxstore"
+)
+
+const (
+	NormalizeStage = "normalize"
+	LengthStage    = "length"
+	KeywordsStage  = "keywords"
+	MetadataStage  = "metadata"
+)
+
+type ProcessingStagesOptions struct {
+	MaxLength int
+	Keywords  []string
+}
+
+// NewPipelineFromStages builds the pipeline from the names of built-in stages.
+func NewPipelineFromStages(names []string, opts ProcessingStagesOptions) (*Pipeline, error) {
+	stages := make([]ProcessingStage, 0, len(names))
+	for _, name := range names {
+		var processor Processor
+		switch name {
+		case NormalizeStage:
+			processor = NormalizeProcessor()
+		case LengthStage:
+			processor = LengthProcessor(opts.MaxLength)
+		case KeywordsStage:
+			processor = KeywordsProcessor(opts.Keywords)
+		case MetadataStage:
+			processor = MetadataProcessor()
+		default:
+			return nil, fmt.Errorf("unknown processing stage %q", name)
+		}
+
+		stages = append(stages, ProcessingStage{Name: name, Processor: processor})
+	}
+
+	return NewPipeline(stages...), nil
+}
+
+// NormalizeProcessor trims the text and collapses whitespace runs into single spaces.
+func NormalizeProcessor() Processor {
+	return ProcessorFunc(func(_ context.Context, msg Message) (ProcessResult, error) {
+		text := strings.Join(strings.Fields(msg.Text), " ")
+		changed := text != msg.Text
+		msg.Text = text
+
+		return ProcessResult{
+			Message: msg,
+			Output:  map[string]any{"text": text, "changed": changed},
+		}, nil
+	})
+}
+
+// LengthProcessor rejects messages longer than maxLength characters. Zero maxLength disables the check.
+func LengthProcessor(maxLength int) Processor {
+	return ProcessorFunc(func(_ context.Context, msg Message) (ProcessResult, error) {
+		length := utf8.RuneCountInString(msg.Text)
+		if length == 0 {
+			return ProcessResult{}, fmt.Errorf("message is empty")
+		}
+		if maxLength > 0 && length > maxLength {
+			return ProcessResult{}, fmt.Errorf("message is longer than %d characters", maxLength)
+		}
+
+		return ProcessResult{
+			Message: msg,
+			Output:  map[string]any{"length": length},
+		}, nil
+	})
+}
+
+// KeywordsProcessor tags the message with the keywords found in its text, ignoring case.
+func KeywordsProcessor(keywords []string) Processor {
+	lowerKeywords := make([]string, 0, len(keywords))
+	for _, keyword := range keywords {
+		if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+			lowerKeywords = append(lowerKeywords, keyword)
+		}
+	}
+
+	return ProcessorFunc(func(_ context.Context, msg Message) (ProcessResult, error) {
+		text := strings.ToLower(msg.Text)
+
+		tags := make([]string, 0)
+		for _, keyword := range lowerKeywords {
+			if strings.Contains(text, keyword) {
+				tags = append(tags, keyword)
+			}
+		}
+
+		return ProcessResult{
+			Message: msg,
+			Output:  map[string]any{"tags": tags},
+		}, nil
+	})
+}
+
+// MetadataProcessor records the metadata of the message event: its source, schema version, tenant and position.
+func MetadataProcessor() Processor {
+	return ProcessorFunc(func(ctx context.Context, msg Message) (ProcessResult, error) {
+		evt, ok := ctxstore.From[Event](ctx, EventKey)
+		if !ok {
+			return ProcessResult{Message: msg, Output: map[string]any{}}, nil
+		}
+
+		output := map[string]any{
+			"topic":       evt.Topic,
+			"partition":   evt.Partition,
+			"offset":      evt.Offset,
+			"contentType": evt.ContentType,
+			"producedAt":  evt.Tstamp,
+		}
+		for _, header := range []string{SourceServiceHeader, SchemaVersionHeader, TenantHeader} {
+			if v, ok := evt.Headers[header]; ok {
+				output[header] = v
+			}
+		}
+
+		return ProcessResult{
+			Message: msg,
+			Output:  output,
+		}, nil
+	})
+}
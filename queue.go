@@ -2,13 +2,36 @@ package main
 
 import (
 	"context"
+	"errors"
+	"strconv"
 	"time"
 )
 
+var ErrQueueClosed = errors.New("queue closed")
+
+const (
+	// TraceIDHeader carries the trace id of the request that produced the event.
+	TraceIDHeader = "trace-id"
+
+	ContentTypeHeader   = "content-type"
+	SourceServiceHeader = "source-service"
+	SchemaVersionHeader = "schema-version"
+	TenantHeader        = "tenant"
+)
+
 type Event struct {
-	Key    []byte
-	Value  []byte
-	Tstamp time.Time
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+	Tstamp  time.Time
+
+	// ContentType of the value, e.g. "application/json".
+	ContentType string
+
+	// Position of the event in the queue. Set for fetched events and used to acknowledge them.
+	Topic     string
+	Partition int
+	Offset    int64
 }
 
 func NewEvent(key []byte, value []byte) Event {
@@ -19,9 +42,64 @@ func NewEvent(key []byte, value []byte) Event {
 	}
 }
 
+func (e Event) TraceID() string {
+	return e.Headers[TraceIDHeader]
+}
+
+// PartitionKeyStrategy selects the key of a message event, events with the same key get into the same partition.
+type PartitionKeyStrategy string
+
+const (
+	PartitionByMessageID  PartitionKeyStrategy = "id"
+	PartitionByRoutingKey PartitionKeyStrategy = "routing_key"
+	PartitionRoundRobin   PartitionKeyStrategy = "round_robin"
+)
+
+func (s PartitionKeyStrategy) Valid() bool {
+	switch s {
+	case PartitionByMessageID, PartitionByRoutingKey, PartitionRoundRobin:
+		return true
+	default:
+		return false
+	}
+}
+
+// Key returns the event key for the message.
+// Messages without a routing key are partitioned by id, a nil key spreads events between partitions.
+func (s PartitionKeyStrategy) Key(msg Message) []byte {
+	switch {
+	case s == PartitionRoundRobin:
+		return nil
+	case s == PartitionByRoutingKey && msg.RoutingKey != "":
+		return []byte(msg.RoutingKey)
+	default:
+		return []byte(strconv.FormatUint(msg.ID, 10))
+	}
+}
+
+// individualAcker is implemented by queues that acknowledge every event on its own
+// instead of committing all the previous offsets of the partition.
+type individualAcker interface {
+	acksIndividually()
+}
+
 type Queue interface {
 	WriteEvents(ctx context.Context, events ...Event) error
+
+	// ReadEvent reads the next event and acknowledges it immediately.
 	ReadEvent(ctx context.Context) (Event, error)
 
+	// FetchEvent reads the next event without acknowledging it.
+	// Fetched events must be acknowledged with AckEvents once they are processed.
+	// The reader moves past fetched events, unacknowledged events are delivered again only after NackEvents.
+	FetchEvent(ctx context.Context) (Event, error)
+	// AckEvents acknowledges the events. An acknowledgement commits all the previous offsets of the partition,
+	// unless the queue is an individualAcker.
+	AckEvents(ctx context.Context, events ...Event) error
+	// NackEvents returns fetched but unacknowledged events to the queue to be delivered again.
+	// Queues with offsets rewind the partitions to the first returned or uncommitted event,
+	// so the events fetched after it are delivered again too.
+	NackEvents(ctx context.Context, events ...Event) error
+
 	Close(ctx context.Context) error
 }
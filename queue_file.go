@@ -0,0 +1,870 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/protomem/msg-processor/pkg/ctxstore"
+)
+
+const (
+	FileQueueScheme = "file://"
+
+	FileSyncAlways   = "always"
+	FileSyncInterval = "interval"
+	FileSyncNever    = "never"
+
+	_fileSegmentExt     = ".log"
+	_fileRecordHeadSize = 8 // payload length and crc32
+)
+
+var _ Queue = (*FileQueue)(nil)
+
+var errFileRecordCorrupted = errors.New("corrupted record")
+
+type FileQueueOptions struct {
+	Dir   string
+	Topic string
+	Group string
+
+	// Sync is the fsync policy of written events and offsets:
+	// always after every write, every SyncInterval or never, leaving it to the OS.
+	Sync         string
+	SyncInterval time.Duration
+
+	// SegmentSize is the size in bytes after which a new segment file is started.
+	SegmentSize int64
+	// Retention is the age after which full segments are deleted. Zero keeps all segments.
+	Retention time.Duration
+}
+
+// ParseFileQueueOptions parses addresses like
+// "file:///var/lib/msg-processor?sync=interval&sync_interval=1s&segment_size=67108864&retention=168h&group=msg-processor".
+func ParseFileQueueOptions(addrs string) (FileQueueOptions, error) {
+	opts := FileQueueOptions{
+		Group:        "msg-processor",
+		Sync:         FileSyncInterval,
+		SyncInterval: time.Second,
+		SegmentSize:  64 << 20, // 64MB
+	}
+
+	path, rawQuery, _ := strings.Cut(strings.TrimPrefix(addrs, FileQueueScheme), "?")
+	if path == "" {
+		return FileQueueOptions{}, fmt.Errorf("file queue address %q has no directory", addrs)
+	}
+	opts.Dir = path
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return FileQueueOptions{}, err
+	}
+
+	if v := query.Get("group"); v != "" {
+		opts.Group = v
+	}
+	if v := query.Get("sync"); v != "" {
+		opts.Sync = v
+	}
+	if v := query.Get("sync_interval"); v != "" {
+		if opts.SyncInterval, err = time.ParseDuration(v); err != nil {
+			return FileQueueOptions{}, err
+		}
+	}
+	if v := query.Get("segment_size"); v != "" {
+		if opts.SegmentSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return FileQueueOptions{}, err
+		}
+	}
+	if v := query.Get("retention"); v != "" {
+		if opts.Retention, err = time.ParseDuration(v); err != nil {
+			return FileQueueOptions{}, err
+		}
+	}
+
+	switch {
+	case opts.Sync != FileSyncAlways && opts.Sync != FileSyncInterval && opts.Sync != FileSyncNever:
+		return FileQueueOptions{}, fmt.Errorf("unknown file queue sync policy %q", opts.Sync)
+	case opts.Sync == FileSyncInterval && opts.SyncInterval <= 0:
+		return FileQueueOptions{}, fmt.Errorf("file queue sync interval must be positive, got %s", opts.SyncInterval)
+	case opts.SegmentSize <= 0:
+		return FileQueueOptions{}, fmt.Errorf("file queue segment size must be positive, got %d", opts.SegmentSize)
+	case opts.Retention < 0:
+		return FileQueueOptions{}, fmt.Errorf("file queue retention must not be negative, got %s", opts.Retention)
+	}
+
+	return opts, nil
+}
+
+// fileRecord is the payload of a record in a segment file.
+// A record is stored as the payload length, the crc32 of the payload and the payload itself.
+type fileRecord struct {
+	Key         []byte            `json:"key,omitempty"`
+	Value       []byte            `json:"value"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Tstamp      time.Time         `json:"tstamp"`
+}
+
+type fileSegment struct {
+	path string
+
+	// base is the offset of the first record, next is the offset after the last one.
+	base int64
+	next int64
+
+	size    int64
+	modTime time.Time
+}
+
+// FileQueue is an append-only log of events split into segment files in Dir/Topic.
+// It has a single partition, the committed offset of the consumer group is kept in Dir/Topic/offsets/Group.
+// The directory is used by one queue at a time, it is locked with Dir/Topic/lock until the queue is closed.
+type FileQueue struct {
+	opts FileQueueOptions
+	log  *slog.Logger
+	dir  string
+	lock *os.File
+
+	mu       sync.Mutex
+	segments []*fileSegment
+	active   *os.File
+	dirty    bool
+	// written is closed and replaced on every write to wake up waiting consumers.
+	written chan struct{}
+
+	readMu   sync.Mutex
+	reader   *os.File
+	readSeg  *fileSegment
+	readPos  int64
+	readNext int64
+
+	commitMu  sync.Mutex
+	committed int64
+
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func NewFileQueue(_ context.Context, log *slog.Logger, opts FileQueueOptions) (*FileQueue, error) {
+	dir := filepath.Join(opts.Dir, opts.Topic)
+	if err := os.MkdirAll(filepath.Join(dir, "offsets"), 0o755); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockFileQueueDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &FileQueue{
+		opts: opts,
+		log:  log.With("component", "fileQueue", "topic", opts.Topic, "group", opts.Group),
+		dir:  dir,
+		lock: lock,
+
+		written: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+
+	if err := q.openSegments(); err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+
+	committed, err := q.readOffset(q.offsetsPath())
+	if err != nil {
+		_ = q.active.Close()
+		_ = lock.Close()
+		return nil, err
+	}
+	q.committed = committed
+	q.readNext = committed
+
+	q.applyRetention()
+
+	q.wg.Add(1)
+	go q.background()
+
+	return q, nil
+}
+
+// lockFileQueueDir takes an exclusive lock of the queue directory. The lock is released when the file is closed,
+// including on a crash of the process.
+func lockFileQueueDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("file queue %s is used by another queue", dir)
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// openSegments loads the segment files and opens the last one for writing.
+// A partially written record at the end of the last segment is truncated.
+func (q *FileQueue) openSegments() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, _fileSegmentExt) {
+			continue
+		}
+
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, _fileSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		q.segments = append(q.segments, &fileSegment{
+			path:    filepath.Join(q.dir, name),
+			base:    base,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	slices.SortFunc(q.segments, func(a, b *fileSegment) int { return cmp.Compare(a.base, b.base) })
+	for i := 0; i+1 < len(q.segments); i++ {
+		q.segments[i].next = q.segments[i+1].base
+	}
+
+	if len(q.segments) == 0 {
+		return q.newSegment(0)
+	}
+
+	last := q.segments[len(q.segments)-1]
+
+	f, err := os.OpenFile(last.path, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	count, size, err := scanFileRecords(f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if size < last.size {
+		q.log.Warn("truncated partially written segment", "segment", last.path, "size", last.size, "validSize", size)
+
+		if err := f.Truncate(size); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	last.next = last.base + count
+	last.size = size
+	q.active = f
+
+	return nil
+}
+
+// scanFileRecords counts the valid records from the start of the file and returns the size they take.
+func scanFileRecords(f *os.File) (count int64, size int64, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for {
+		n, err := readFileRecord(f, size, info.Size(), nil)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errFileRecordCorrupted) {
+			return count, size, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		count++
+		size += n
+	}
+}
+
+// readFileRecord reads the record at pos into rec, if it is not nil, and returns the size of the record.
+// The record must end before end, the size of the written part of the file.
+func readFileRecord(f *os.File, pos, end int64, rec *fileRecord) (int64, error) {
+	head := make([]byte, _fileRecordHeadSize)
+	if _, err := f.ReadAt(head, pos); err != nil {
+		return 0, err
+	}
+
+	length := binary.BigEndian.Uint32(head[:4])
+	checksum := binary.BigEndian.Uint32(head[4:])
+
+	// A corrupted length must not allocate more than the file holds.
+	if int64(length) > end-pos-_fileRecordHeadSize {
+		return 0, errFileRecordCorrupted
+	}
+
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, pos+_fileRecordHeadSize); err != nil {
+		return 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return 0, errFileRecordCorrupted
+	}
+
+	if rec != nil {
+		if err := json.Unmarshal(payload, rec); err != nil {
+			return 0, fmt.Errorf("%w: %w", errFileRecordCorrupted, err)
+		}
+	}
+
+	return _fileRecordHeadSize + int64(length), nil
+}
+
+func encodeFileRecord(evt Event) ([]byte, error) {
+	payload, err := json.Marshal(fileRecord{
+		Key:         evt.Key,
+		Value:       evt.Value,
+		Headers:     evt.Headers,
+		ContentType: evt.ContentType,
+		Tstamp:      evt.Tstamp,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, _fileRecordHeadSize, _fileRecordHeadSize+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	return append(buf, payload...), nil
+}
+
+// newSegment starts a new active segment with the base offset.
+// Must be called with the lock held.
+func (q *FileQueue) newSegment(base int64) error {
+	path := filepath.Join(q.dir, fmt.Sprintf("%020d%s", base, _fileSegmentExt))
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	q.segments = append(q.segments, &fileSegment{
+		path:    path,
+		base:    base,
+		next:    base,
+		modTime: time.Now(),
+	})
+	q.active = f
+
+	return nil
+}
+
+// rotate closes the active segment and starts a new one.
+// Must be called with the lock held.
+func (q *FileQueue) rotate() error {
+	if err := q.active.Sync(); err != nil {
+		return err
+	}
+	if err := q.active.Close(); err != nil {
+		return err
+	}
+	q.dirty = false
+
+	last := q.segments[len(q.segments)-1]
+	return q.newSegment(last.next)
+}
+
+func (q *FileQueue) WriteEvents(ctx context.Context, events ...Event) error {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	if err := ctx.Err(); err != nil {
+		log.Debug("failed to write events", "error", err)
+
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Close closes the active segment under the lock, so the check must be under it too.
+	select {
+	case <-q.closed:
+		return ErrQueueClosed
+	default:
+	}
+
+	rotated := false
+	for _, evt := range events {
+		if evt.Tstamp.IsZero() {
+			evt.Tstamp = time.Now()
+		}
+
+		rec, err := encodeFileRecord(evt)
+		if err != nil {
+			return err
+		}
+
+		last := q.segments[len(q.segments)-1]
+		if last.size > 0 && last.size+int64(len(rec)) > q.opts.SegmentSize {
+			if err := q.rotate(); err != nil {
+				log.Debug("failed to rotate segment", "error", err)
+
+				return err
+			}
+			last = q.segments[len(q.segments)-1]
+			rotated = true
+		}
+
+		if _, err := q.active.Write(rec); err != nil {
+			log.Debug("failed to write events", "error", err)
+
+			// Drop the partially written record, so the segment stays readable.
+			_ = q.active.Truncate(last.size)
+			_, _ = q.active.Seek(last.size, io.SeekStart)
+			return err
+		}
+
+		last.size += int64(len(rec))
+		last.next++
+		last.modTime = time.Now()
+		q.dirty = true
+	}
+
+	if q.opts.Sync == FileSyncAlways {
+		if err := q.active.Sync(); err != nil {
+			log.Debug("failed to sync segment", "error", err)
+
+			return err
+		}
+		q.dirty = false
+	}
+
+	close(q.written)
+	q.written = make(chan struct{})
+
+	if rotated {
+		q.applyRetentionLocked()
+	}
+
+	log.Debug("written events", "countEvents", len(events))
+
+	return nil
+}
+
+func (q *FileQueue) ReadEvent(ctx context.Context) (Event, error) {
+	evt, err := q.FetchEvent(ctx)
+	if err != nil {
+		return Event{}, err
+	}
+
+	if err := q.AckEvents(ctx, evt); err != nil {
+		return Event{}, err
+	}
+
+	return evt, nil
+}
+
+func (q *FileQueue) FetchEvent(ctx context.Context) (Event, error) {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	for {
+		select {
+		case <-q.closed:
+			return Event{}, ErrQueueClosed
+		default:
+		}
+
+		evt, ok, written, err := q.nextEvent()
+		if err != nil {
+			log.Debug("failed to fetch event", "error", err)
+
+			return Event{}, err
+		}
+		if ok {
+			log.Debug("fetched event", "offset", evt.Offset)
+
+			return evt, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Debug("failed to fetch event", "error", ctx.Err())
+
+			return Event{}, ctx.Err()
+		case <-q.closed:
+			return Event{}, ErrQueueClosed
+		case <-written:
+		}
+	}
+}
+
+// nextEvent reads the event at readNext, if it is written.
+// Otherwise it returns the channel closed on the next write.
+func (q *FileQueue) nextEvent() (Event, bool, <-chan struct{}, error) {
+	q.readMu.Lock()
+	defer q.readMu.Unlock()
+
+	q.mu.Lock()
+	written := q.written
+
+	// Events deleted by retention are skipped.
+	if first := q.segments[0]; q.readNext < first.base {
+		q.readNext = first.base
+	}
+
+	var seg *fileSegment
+	for _, s := range q.segments {
+		if q.readNext >= s.base && q.readNext < s.next {
+			seg = s
+			break
+		}
+	}
+	var end int64
+	if seg != nil {
+		end = seg.size
+	}
+	q.mu.Unlock()
+
+	if seg == nil {
+		return Event{}, false, written, nil
+	}
+
+	if q.readSeg != seg {
+		if err := q.openReader(seg, end); err != nil {
+			return Event{}, false, nil, err
+		}
+	}
+
+	if q.readPos >= end {
+		return Event{}, false, written, nil
+	}
+
+	var rec fileRecord
+	n, err := readFileRecord(q.reader, q.readPos, end, &rec)
+	if err != nil {
+		return Event{}, false, nil, fmt.Errorf("read segment %s at %d: %w", seg.path, q.readPos, err)
+	}
+
+	evt := Event{
+		Key:         rec.Key,
+		Value:       rec.Value,
+		Headers:     rec.Headers,
+		Tstamp:      rec.Tstamp,
+		ContentType: rec.ContentType,
+
+		Topic:     q.opts.Topic,
+		Partition: 0,
+		Offset:    q.readNext,
+	}
+
+	q.readPos += n
+	q.readNext++
+
+	return evt, true, written, nil
+}
+
+// openReader opens the segment of end bytes for reading and skips to readNext.
+// Must be called with the read lock held.
+func (q *FileQueue) openReader(seg *fileSegment, end int64) error {
+	if q.reader != nil {
+		_ = q.reader.Close()
+		q.reader, q.readSeg = nil, nil
+	}
+
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+
+	pos := int64(0)
+	for offset := seg.base; offset < q.readNext; offset++ {
+		n, err := readFileRecord(f, pos, end, nil)
+		if err != nil {
+			_ = f.Close()
+			return fmt.Errorf("read segment %s at %d: %w", seg.path, pos, err)
+		}
+		pos += n
+	}
+
+	q.reader, q.readSeg, q.readPos = f, seg, pos
+
+	return nil
+}
+
+func (q *FileQueue) AckEvents(ctx context.Context, events ...Event) error {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	q.commitMu.Lock()
+	defer q.commitMu.Unlock()
+
+	committed := q.committed
+	for _, evt := range events {
+		committed = max(committed, evt.Offset+1)
+	}
+	if committed == q.committed {
+		return nil
+	}
+
+	if err := q.writeCommitted(committed); err != nil {
+		log.Debug("failed to ack events", "error", err)
+
+		return err
+	}
+	q.committed = committed
+
+	log.Debug("acked events", "countEvents", len(events), "committed", committed)
+
+	return nil
+}
+
+func (q *FileQueue) NackEvents(ctx context.Context, events ...Event) error {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	q.readMu.Lock()
+	defer q.readMu.Unlock()
+
+	q.commitMu.Lock()
+	committed := q.committed
+	q.commitMu.Unlock()
+
+	readNext := q.readNext
+	for _, evt := range events {
+		readNext = min(readNext, evt.Offset)
+	}
+	readNext = max(readNext, committed)
+
+	if readNext != q.readNext {
+		// The reader is reopened and skips to the new position on the next fetch.
+		if q.reader != nil {
+			_ = q.reader.Close()
+		}
+		q.reader, q.readSeg, q.readPos = nil, nil, 0
+		q.readNext = readNext
+	}
+
+	log.Debug("nacked events", "countEvents", len(events), "next", readNext)
+
+	return nil
+}
+
+func (q *FileQueue) offsetsPath() string {
+	return filepath.Join(q.dir, "offsets", q.opts.Group)
+}
+
+func (q *FileQueue) readOffset(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// minCommitted returns the lowest offset committed by the consumer groups of the topic.
+// ok is false if no group has committed yet.
+func (q *FileQueue) minCommitted() (committed int64, ok bool, err error) {
+	entries, err := os.ReadDir(filepath.Join(q.dir, "offsets"))
+	if err != nil {
+		return 0, false, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+
+		offset, err := q.readOffset(filepath.Join(q.dir, "offsets", entry.Name()))
+		if err != nil {
+			return 0, false, err
+		}
+
+		if !ok || offset < committed {
+			committed, ok = offset, true
+		}
+	}
+
+	return committed, ok, nil
+}
+
+// writeCommitted replaces the offsets file through a temporary file, so a crash leaves either the old or the new offset.
+func (q *FileQueue) writeCommitted(committed int64) error {
+	path := q.offsetsPath()
+	tmpPath := path + ".tmp"
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strconv.FormatInt(committed, 10)); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if q.opts.Sync != FileSyncNever {
+		if err := f.Sync(); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// background syncs the active segment by the interval policy and applies the retention.
+func (q *FileQueue) background() {
+	defer q.wg.Done()
+
+	syncInterval := q.opts.SyncInterval
+	if q.opts.Sync != FileSyncInterval {
+		syncInterval = time.Minute
+	}
+
+	syncTicker := time.NewTicker(syncInterval)
+	defer syncTicker.Stop()
+
+	retentionTicker := time.NewTicker(time.Minute)
+	defer retentionTicker.Stop()
+
+	for {
+		select {
+		case <-q.closed:
+			return
+		case <-syncTicker.C:
+			if q.opts.Sync == FileSyncInterval {
+				q.sync()
+			}
+		case <-retentionTicker.C:
+			q.applyRetention()
+		}
+	}
+}
+
+func (q *FileQueue) sync() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.dirty {
+		return
+	}
+
+	if err := q.active.Sync(); err != nil {
+		q.log.Error("failed to sync segment", "error", err)
+		return
+	}
+	q.dirty = false
+}
+
+func (q *FileQueue) applyRetention() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.applyRetentionLocked()
+}
+
+// applyRetentionLocked deletes the full segments older than the retention. The active segment is kept,
+// as well as the segments with events not committed by every consumer group of the topic.
+// Must be called with the lock held.
+func (q *FileQueue) applyRetentionLocked() {
+	if q.opts.Retention <= 0 {
+		return
+	}
+
+	committed, ok, err := q.minCommitted()
+	if err != nil {
+		q.log.Error("failed to read committed offsets", "error", err)
+		return
+	}
+
+	deadline := time.Now().Add(-q.opts.Retention)
+	for len(q.segments) > 1 && q.segments[0].modTime.Before(deadline) {
+		seg := q.segments[0]
+		if ok && seg.next > committed {
+			break
+		}
+
+		// The reader keeps its file open, so removal is safe on unix systems.
+		if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			q.log.Error("failed to delete segment", "segment", seg.path, "error", err)
+			return
+		}
+
+		q.log.Info("deleted segment", "segment", seg.path, "baseOffset", seg.base, "nextOffset", seg.next)
+		q.segments = q.segments[1:]
+	}
+
+	var kept int
+	for _, seg := range q.segments[:len(q.segments)-1] {
+		if seg.modTime.Before(deadline) {
+			kept++
+		}
+	}
+	if kept > 0 {
+		q.log.Warn("kept expired segments with uncommitted events", "countSegments", kept, "committed", committed)
+	}
+}
+
+// Close flushes the active segment and stops the consumer.
+// Fetched but unacknowledged events are delivered again after reopening.
+func (q *FileQueue) Close(_ context.Context) error {
+	var errs error
+	q.closeOnce.Do(func() {
+		close(q.closed)
+		q.wg.Wait()
+
+		q.mu.Lock()
+		if q.opts.Sync != FileSyncNever {
+			errs = errors.Join(errs, q.active.Sync())
+		}
+		errs = errors.Join(errs, q.active.Close())
+		q.mu.Unlock()
+
+		q.readMu.Lock()
+		if q.reader != nil {
+			errs = errors.Join(errs, q.reader.Close())
+		}
+		q.readMu.Unlock()
+
+		errs = errors.Join(errs, q.lock.Close())
+	})
+	return errs
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFileQueue(t *testing.T, dir string) *FileQueue {
+	t.Helper()
+
+	opts, err := ParseFileQueueOptions(FileQueueScheme + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Topic = "messages"
+
+	q, err := NewFileQueue(context.Background(), newTestLogger(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = q.Close(context.Background()) })
+
+	return q
+}
+
+func TestReadFileRecordRejectsLengthPastEnd(t *testing.T) {
+	rec, err := encodeFileRecord(NewEvent(nil, []byte("one")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(rec[:4], 1<<31)
+
+	path := filepath.Join(t.TempDir(), "segment.log")
+	if err := os.WriteFile(path, rec, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := readFileRecord(f, 0, int64(len(rec)), nil); !errors.Is(err, errFileRecordCorrupted) {
+		t.Fatalf("got %v, want %v", err, errFileRecordCorrupted)
+	}
+}
+
+func TestFileQueueDropsRecordWithCorruptedLength(t *testing.T) {
+	ctx := newTestContext(t)
+	dir := t.TempDir()
+
+	q := newTestFileQueue(t, dir)
+	if err := q.WriteEvents(ctx, NewEvent(nil, []byte("one"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Append a record whose length points far past the end of the segment.
+	segments, err := filepath.Glob(filepath.Join(dir, "messages", "*"+_fileSegmentExt))
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("got segments %v and %v", segments, err)
+	}
+	head := make([]byte, _fileRecordHeadSize)
+	binary.BigEndian.PutUint32(head[:4], 1<<31)
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(head); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	q = newTestFileQueue(t, dir)
+	evt, err := q.ReadEvent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(evt.Value) != "one" {
+		t.Fatalf("got event %s, want one", evt.Value)
+	}
+	expectNoEvent(t, ctx, q)
+}
+
+func TestFileQueueWriteRacesClose(t *testing.T) {
+	ctx := newTestContext(t)
+	q := newTestFileQueue(t, t.TempDir())
+
+	var wg, started sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for n := 0; ; n++ {
+				err := q.WriteEvents(ctx, NewEvent(nil, []byte("event")))
+				if n == 0 {
+					started.Done()
+				}
+				if errors.Is(err, ErrQueueClosed) {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	// Writes that pass the closed check must not reach the closed segment.
+	started.Wait()
+	if err := q.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+func TestFileQueueLocksDirectory(t *testing.T) {
+	ctx := newTestContext(t)
+	dir := t.TempDir()
+
+	q := newTestFileQueue(t, dir)
+
+	opts, err := ParseFileQueueOptions(FileQueueScheme + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Topic = "messages"
+
+	if other, err := NewFileQueue(ctx, newTestLogger(), opts); err == nil {
+		_ = other.Close(ctx)
+		t.Fatal("opened the directory used by another queue")
+	}
+
+	if err := q.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	newTestFileQueue(t, dir)
+}
+
+func TestFileQueueRetentionKeepsUncommittedSegments(t *testing.T) {
+	ctx := newTestContext(t)
+	dir := t.TempDir()
+
+	opts, err := ParseFileQueueOptions(FileQueueScheme + dir + "?segment_size=1&retention=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Topic = "messages"
+
+	q, err := NewFileQueue(ctx, newTestLogger(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"one", "two", "three"} {
+		if err := q.WriteEvents(ctx, NewEvent(nil, []byte(value))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	evt, err := q.FetchEvent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.AckEvents(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := filepath.Glob(filepath.Join(dir, "messages", "*"+_fileSegmentExt))
+	if err != nil || len(segments) != 3 {
+		t.Fatalf("got segments %v and %v, want 3", segments, err)
+	}
+	expired := time.Now().Add(-2 * time.Hour)
+	for _, segment := range segments {
+		if err := os.Chtimes(segment, expired, expired); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the committed segment is deleted on reopening, the active one is always kept.
+	q, err = NewFileQueue(ctx, newTestLogger(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = q.Close(context.Background()) })
+
+	if segments, err := filepath.Glob(filepath.Join(dir, "messages", "*"+_fileSegmentExt)); err != nil || len(segments) != 2 {
+		t.Fatalf("got segments %v and %v, want 2", segments, err)
+	}
+
+	evt, err = q.ReadEvent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(evt.Value) != "two" {
+		t.Fatalf("got event %s, want two", evt.Value)
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/protomem/msg-processor/pkg/ctxstore"
 	"github.com/segmentio/kafka-go"
@@ -13,9 +16,139 @@ import (
 
 var _ Queue = (*KafkaQueue)(nil)
 
+const (
+	DefaultKafkaGroupID      = "msg-processor"
+	DefaultKafkaStartOffset  = "earliest"
+	DefaultKafkaBatchSize    = 100
+	DefaultKafkaBatchTimeout = 10 * time.Millisecond
+	DefaultKafkaRequiredAcks = "all"
+	DefaultKafkaCompression  = "none"
+	DefaultKafkaMinBytes     = 1
+	DefaultKafkaMaxBytes     = 10e6 // 10MB
+)
+
 type KafkaQueueOptions struct {
 	Addrs string
 	Topic string
+
+	// Consumer options.
+	GroupID string
+	// StartOffset is the offset a new consumer group starts from: earliest or latest.
+	StartOffset string
+	MinBytes    int
+	MaxBytes    int
+	// CommitInterval batches the offset commits. Zero commits the acknowledged events synchronously.
+	CommitInterval time.Duration
+
+	// Producer options. Writes are synchronous, WriteEvents returns once the batch is acknowledged.
+	BatchSize    int
+	BatchTimeout time.Duration
+	// RequiredAcks is none, one or all.
+	RequiredAcks string
+	// Compression is none, gzip, snappy, lz4 or zstd.
+	Compression string
+}
+
+// withDefaults fills the zero tuning options with the defaults.
+func (opts KafkaQueueOptions) withDefaults() KafkaQueueOptions {
+	if opts.GroupID == "" {
+		opts.GroupID = DefaultKafkaGroupID
+	}
+	if opts.StartOffset == "" {
+		opts.StartOffset = DefaultKafkaStartOffset
+	}
+	if opts.MinBytes == 0 {
+		opts.MinBytes = DefaultKafkaMinBytes
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = DefaultKafkaMaxBytes
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = DefaultKafkaBatchSize
+	}
+	if opts.BatchTimeout == 0 {
+		opts.BatchTimeout = DefaultKafkaBatchTimeout
+	}
+	if opts.RequiredAcks == "" {
+		opts.RequiredAcks = DefaultKafkaRequiredAcks
+	}
+	if opts.Compression == "" {
+		opts.Compression = DefaultKafkaCompression
+	}
+	return opts
+}
+
+func (opts KafkaQueueOptions) validate() error {
+	var errs error
+
+	if _, err := kafkaStartOffset(opts.StartOffset); err != nil {
+		errs = errors.Join(errs, err)
+	}
+	if _, err := kafkaRequiredAcks(opts.RequiredAcks); err != nil {
+		errs = errors.Join(errs, err)
+	}
+	if _, err := kafkaCompression(opts.Compression); err != nil {
+		errs = errors.Join(errs, err)
+	}
+
+	if opts.MinBytes < 1 {
+		errs = errors.Join(errs, fmt.Errorf("kafka min bytes must be positive, got %d", opts.MinBytes))
+	}
+	if opts.MaxBytes < opts.MinBytes {
+		errs = errors.Join(errs, fmt.Errorf("kafka max bytes %d is less than min bytes %d", opts.MaxBytes, opts.MinBytes))
+	}
+	if opts.BatchSize < 1 {
+		errs = errors.Join(errs, fmt.Errorf("kafka batch size must be positive, got %d", opts.BatchSize))
+	}
+	if opts.BatchTimeout < 0 {
+		errs = errors.Join(errs, fmt.Errorf("kafka batch timeout must not be negative, got %s", opts.BatchTimeout))
+	}
+	if opts.CommitInterval < 0 {
+		errs = errors.Join(errs, fmt.Errorf("kafka commit interval must not be negative, got %s", opts.CommitInterval))
+	}
+
+	return errs
+}
+
+func kafkaStartOffset(offset string) (int64, error) {
+	switch strings.ToLower(offset) {
+	case "earliest":
+		return kafka.FirstOffset, nil
+	case "latest":
+		return kafka.LastOffset, nil
+	default:
+		return 0, fmt.Errorf("unknown kafka start offset %q", offset)
+	}
+}
+
+func kafkaRequiredAcks(acks string) (kafka.RequiredAcks, error) {
+	switch strings.ToLower(acks) {
+	case "none":
+		return kafka.RequireNone, nil
+	case "one":
+		return kafka.RequireOne, nil
+	case "all":
+		return kafka.RequireAll, nil
+	default:
+		return 0, fmt.Errorf("unknown kafka required acks %q", acks)
+	}
+}
+
+func kafkaCompression(codec string) (kafka.Compression, error) {
+	switch strings.ToLower(codec) {
+	case "none":
+		return 0, nil
+	case "gzip":
+		return kafka.Gzip, nil
+	case "snappy":
+		return kafka.Snappy, nil
+	case "lz4":
+		return kafka.Lz4, nil
+	case "zstd":
+		return kafka.Zstd, nil
+	default:
+		return 0, fmt.Errorf("unknown kafka compression %q", codec)
+	}
 }
 
 type KafkaQueue struct {
@@ -23,36 +156,69 @@ type KafkaQueue struct {
 	log  *slog.Logger
 
 	writer *kafka.Writer
-	reader *kafka.Reader
+
+	// The reader joins the consumer group on creation,
+	// so it is created on the first read to keep write-only queues out of the group.
+	// NackEvents closes the reader to rewind it to the committed offsets, the next read creates it again.
+	readerMu  sync.Mutex
+	readerCfg kafka.ReaderConfig
+	reader    *kafka.Reader
 }
 
 func NewKafkaQueue(ctx context.Context, log *slog.Logger, opts KafkaQueueOptions) (*KafkaQueue, error) {
 	addrs := strings.Split(opts.Addrs, ",")
 
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	// The options are validated above.
+	startOffset, _ := kafkaStartOffset(opts.StartOffset)
+	requiredAcks, _ := kafkaRequiredAcks(opts.RequiredAcks)
+	compression, _ := kafkaCompression(opts.Compression)
+
 	writer := &kafka.Writer{
 		Addr:                   kafka.TCP(addrs...),
 		Topic:                  opts.Topic,
 		Balancer:               &kafka.Hash{},
 		AllowAutoTopicCreation: true,
+		BatchSize:              opts.BatchSize,
+		BatchTimeout:           opts.BatchTimeout,
+		RequiredAcks:           requiredAcks,
+		Compression:            compression,
 	}
 
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:   addrs,
-		Topic:     opts.Topic,
-		GroupID:   "msg-processor",
-		Partition: 0,
-		MaxBytes:  10e6, // 10MB
-	})
+	readerCfg := kafka.ReaderConfig{
+		Brokers:        addrs,
+		Topic:          opts.Topic,
+		GroupID:        opts.GroupID,
+		StartOffset:    startOffset,
+		MinBytes:       opts.MinBytes,
+		MaxBytes:       opts.MaxBytes,
+		CommitInterval: opts.CommitInterval,
+	}
 
 	return &KafkaQueue{
 		opts: opts,
-		log:  log.With("component", "kafkaQueue"),
+		log:  log.With("component", "kafkaQueue", "topic", opts.Topic),
 
-		writer: writer,
-		reader: reader,
+		writer:    writer,
+		readerCfg: readerCfg,
 	}, nil
 }
 
+func (q *KafkaQueue) getReader() *kafka.Reader {
+	q.readerMu.Lock()
+	defer q.readerMu.Unlock()
+
+	if q.reader == nil {
+		q.reader = kafka.NewReader(q.readerCfg)
+	}
+
+	return q.reader
+}
+
 func (q *KafkaQueue) WriteEvents(ctx context.Context, events ...Event) error {
 	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
 	msgs := kafakMsgsFromEvents(events...)
@@ -71,7 +237,7 @@ func (q *KafkaQueue) WriteEvents(ctx context.Context, events ...Event) error {
 func (q *KafkaQueue) ReadEvent(ctx context.Context) (Event, error) {
 	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
 
-	msg, err := q.reader.ReadMessage(ctx)
+	msg, err := q.getReader().ReadMessage(ctx)
 	if err != nil {
 		log.Debug("failed to read event", "error", err)
 
@@ -83,6 +249,78 @@ func (q *KafkaQueue) ReadEvent(ctx context.Context) (Event, error) {
 	return eventFromKafkaMsg(msg), nil
 }
 
+func (q *KafkaQueue) FetchEvent(ctx context.Context) (Event, error) {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	msg, err := q.getReader().FetchMessage(ctx)
+	if err != nil {
+		log.Debug("failed to fetch event", "error", err)
+
+		return Event{}, err
+	}
+
+	log.Debug("fetched event", "partition", msg.Partition, "offset", msg.Offset)
+
+	return eventFromKafkaMsg(msg), nil
+}
+
+func (q *KafkaQueue) AckEvents(ctx context.Context, events ...Event) error {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	msgs := make([]kafka.Message, len(events))
+	for i := 0; i < len(events); i++ {
+		msgs[i] = kafka.Message{
+			Topic:     q.opts.Topic,
+			Partition: events[i].Partition,
+			Offset:    events[i].Offset,
+		}
+	}
+
+	if err := q.getReader().CommitMessages(ctx, msgs...); err != nil {
+		log.Debug("failed to ack events", "error", err)
+
+		return err
+	}
+
+	log.Debug("acked events", "countEvents", len(msgs))
+
+	return nil
+}
+
+// NackEvents recreates the reader of the consumer group,
+// so the fetching resumes from the committed offsets of all partitions.
+func (q *KafkaQueue) NackEvents(ctx context.Context, events ...Event) error {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	q.readerMu.Lock()
+	defer q.readerMu.Unlock()
+
+	if q.reader == nil {
+		return nil
+	}
+
+	// Closing the reader flushes the pending commits and leaves the group.
+	err := q.reader.Close()
+	q.reader = nil
+	if err != nil {
+		log.Debug("failed to nack events", "error", err)
+
+		return err
+	}
+
+	log.Debug("nacked events", "countEvents", len(events))
+
+	return nil
+}
+
 func (q *KafkaQueue) Close(_ context.Context) error {
 	var errs error
 
@@ -90,25 +328,63 @@ func (q *KafkaQueue) Close(_ context.Context) error {
 		errs = errors.Join(errs, err)
 	}
 
-	if err := q.reader.Close(); err != nil {
-		errs = errors.Join(errs, err)
+	q.readerMu.Lock()
+	defer q.readerMu.Unlock()
+
+	if q.reader != nil {
+		if err := q.reader.Close(); err != nil {
+			errs = errors.Join(errs, err)
+		}
 	}
 
 	return errs
 }
 
 func kafkaMsgFromEvent(evt Event) kafka.Message {
+	headers := make([]kafka.Header, 0, len(evt.Headers)+1)
+	for k, v := range evt.Headers {
+		headers = append(headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	if evt.ContentType != "" {
+		headers = append(headers, kafka.Header{Key: ContentTypeHeader, Value: []byte(evt.ContentType)})
+	}
+
 	return kafka.Message{
-		Key:   bytes.Clone(evt.Key),
-		Value: bytes.Clone(evt.Value),
+		Key:     bytes.Clone(evt.Key),
+		Value:   bytes.Clone(evt.Value),
+		Headers: headers,
+		Time:    evt.Tstamp,
 	}
 }
 
 func eventFromKafkaMsg(msg kafka.Message) Event {
+	var (
+		headers     map[string]string
+		contentType string
+	)
+	for _, h := range msg.Headers {
+		if h.Key == ContentTypeHeader {
+			contentType = string(h.Value)
+			continue
+		}
+
+		if headers == nil {
+			headers = make(map[string]string, len(msg.Headers))
+		}
+		headers[h.Key] = string(h.Value)
+	}
+
 	return Event{
-		Key:    bytes.Clone(msg.Key),
-		Value:  bytes.Clone(msg.Value),
-		Tstamp: msg.Time,
+		Key:     bytes.Clone(msg.Key),
+		Value:   bytes.Clone(msg.Value),
+		Headers: headers,
+		Tstamp:  msg.Time,
+
+		ContentType: contentType,
+
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
 	}
 }
 
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/protomem/msg-processor/pkg/ctxstore"
+)
+
+const MemoryQueueScheme = "memory://"
+
+var _ Queue = (*MemoryQueue)(nil)
+
+type MemoryQueueOptions struct {
+	Topic      string
+	Partitions int
+	Group      string
+}
+
+// ParseMemoryQueueOptions parses addresses like "memory://?partitions=4&group=msg-processor".
+func ParseMemoryQueueOptions(addrs string) (MemoryQueueOptions, error) {
+	opts := MemoryQueueOptions{
+		Partitions: 1,
+		Group:      "msg-processor",
+	}
+
+	u, err := url.Parse(addrs)
+	if err != nil {
+		return MemoryQueueOptions{}, err
+	}
+
+	if v := u.Query().Get("partitions"); v != "" {
+		opts.Partitions, err = strconv.Atoi(v)
+		if err != nil {
+			return MemoryQueueOptions{}, err
+		}
+	}
+
+	if v := u.Query().Get("group"); v != "" {
+		opts.Group = v
+	}
+
+	return opts, nil
+}
+
+type memoryPartition struct {
+	// base is the offset of the first kept event, the events before it are committed by every group and dropped.
+	base   int64
+	events []Event
+}
+
+type memoryTopic struct {
+	log *slog.Logger
+
+	mu sync.Mutex
+
+	partitions []memoryPartition
+	groups     map[string]*memoryGroup
+	nextRR     int
+
+	// written is closed and replaced on every write to wake up waiting consumers.
+	written chan struct{}
+}
+
+type memoryGroup struct {
+	committed []int64
+	fetched   []int64
+	next      int
+}
+
+// group returns the consumer group, a new group starts from the first kept event.
+// Must be called with the topic lock held.
+func (t *memoryTopic) group(name string) *memoryGroup {
+	g, ok := t.groups[name]
+	if !ok {
+		g = &memoryGroup{
+			committed: make([]int64, len(t.partitions)),
+			fetched:   make([]int64, len(t.partitions)),
+		}
+		for p, part := range t.partitions {
+			g.committed[p] = part.base
+			g.fetched[p] = part.base
+		}
+		t.groups[name] = g
+	}
+	return g
+}
+
+// compact drops the events of the partition committed by every group.
+// Must be called with the topic lock held.
+func (t *memoryTopic) compact(p int) {
+	part := &t.partitions[p]
+
+	next := part.base + int64(len(part.events))
+	for _, g := range t.groups {
+		next = min(next, g.committed[p])
+	}
+	if next <= part.base {
+		return
+	}
+
+	part.events = slices.Delete(part.events, 0, int(next-part.base))
+	part.base = next
+}
+
+// wakeup wakes up the consumers waiting for new events.
+// Must be called with the topic lock held.
+func (t *memoryTopic) wakeup() {
+	close(t.written)
+	t.written = make(chan struct{})
+}
+
+// MemoryQueue keeps the events of a topic in the process memory and consumes them as a consumer group.
+// Events are dropped once every group of the topic has acknowledged them.
+type MemoryQueue struct {
+	opts MemoryQueueOptions
+	log  *slog.Logger
+
+	topic *memoryTopic
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func NewMemoryQueue(_ context.Context, log *slog.Logger, opts MemoryQueueOptions) (*MemoryQueue, error) {
+	if opts.Partitions < 1 {
+		opts.Partitions = 1
+	}
+
+	topic := &memoryTopic{
+		log: log.With("component", "memoryQueue", "topic", opts.Topic),
+
+		partitions: make([]memoryPartition, opts.Partitions),
+		groups:     make(map[string]*memoryGroup),
+		written:    make(chan struct{}),
+	}
+
+	return newMemoryQueue(topic, opts), nil
+}
+
+func newMemoryQueue(topic *memoryTopic, opts MemoryQueueOptions) *MemoryQueue {
+	// The group is joined right away, so it receives every event written after it.
+	topic.mu.Lock()
+	topic.group(opts.Group)
+	topic.mu.Unlock()
+
+	return &MemoryQueue{
+		opts: opts,
+		log:  topic.log.With("group", opts.Group),
+
+		topic:  topic,
+		closed: make(chan struct{}),
+	}
+}
+
+// WithGroup returns a queue sharing the same events but consuming them as another consumer group.
+func (q *MemoryQueue) WithGroup(group string) *MemoryQueue {
+	opts := q.opts
+	opts.Group = group
+	return newMemoryQueue(q.topic, opts)
+}
+
+func (q *MemoryQueue) WriteEvents(ctx context.Context, events ...Event) error {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	if err := ctx.Err(); err != nil {
+		log.Debug("failed to write events", "error", err)
+
+		return err
+	}
+
+	q.topic.mu.Lock()
+	defer q.topic.mu.Unlock()
+
+	select {
+	case <-q.closed:
+		return ErrQueueClosed
+	default:
+	}
+
+	for _, evt := range events {
+		p := q.partitionFor(evt.Key)
+		part := &q.topic.partitions[p]
+
+		evt.Key = bytes.Clone(evt.Key)
+		evt.Value = bytes.Clone(evt.Value)
+		evt.Headers = maps.Clone(evt.Headers)
+		evt.Topic = q.opts.Topic
+		evt.Partition = p
+		evt.Offset = part.base + int64(len(part.events))
+
+		part.events = append(part.events, evt)
+	}
+
+	q.topic.wakeup()
+
+	log.Debug("written events", "countEvents", len(events))
+
+	return nil
+}
+
+func (q *MemoryQueue) ReadEvent(ctx context.Context) (Event, error) {
+	evt, err := q.FetchEvent(ctx)
+	if err != nil {
+		return Event{}, err
+	}
+
+	if err := q.AckEvents(ctx, evt); err != nil {
+		return Event{}, err
+	}
+
+	return evt, nil
+}
+
+func (q *MemoryQueue) FetchEvent(ctx context.Context) (Event, error) {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	for {
+		q.topic.mu.Lock()
+		evt, ok := q.nextEvent()
+		written := q.topic.written
+		q.topic.mu.Unlock()
+
+		if ok {
+			log.Debug("fetched event", "partition", evt.Partition, "offset", evt.Offset)
+
+			return evt, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Debug("failed to fetch event", "error", ctx.Err())
+
+			return Event{}, ctx.Err()
+		case <-q.closed:
+			return Event{}, ErrQueueClosed
+		case <-written:
+		}
+	}
+}
+
+func (q *MemoryQueue) AckEvents(ctx context.Context, events ...Event) error {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	q.topic.mu.Lock()
+	defer q.topic.mu.Unlock()
+
+	g := q.topic.group(q.opts.Group)
+	for _, evt := range events {
+		if evt.Partition < 0 || evt.Partition >= len(q.topic.partitions) {
+			continue
+		}
+		part := q.topic.partitions[evt.Partition]
+
+		next := min(evt.Offset+1, part.base+int64(len(part.events)))
+		if next <= g.committed[evt.Partition] {
+			continue
+		}
+		g.committed[evt.Partition] = next
+		g.fetched[evt.Partition] = max(g.fetched[evt.Partition], next)
+
+		q.topic.compact(evt.Partition)
+	}
+
+	log.Debug("acked events", "countEvents", len(events))
+
+	return nil
+}
+
+func (q *MemoryQueue) NackEvents(ctx context.Context, events ...Event) error {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	q.topic.mu.Lock()
+	defer q.topic.mu.Unlock()
+
+	g := q.topic.group(q.opts.Group)
+	for _, evt := range events {
+		if evt.Partition < 0 || evt.Partition >= len(q.topic.partitions) {
+			continue
+		}
+
+		g.fetched[evt.Partition] = max(g.committed[evt.Partition], min(g.fetched[evt.Partition], evt.Offset))
+	}
+
+	if len(events) > 0 {
+		q.topic.wakeup()
+	}
+
+	log.Debug("nacked events", "countEvents", len(events))
+
+	return nil
+}
+
+// Close stops the consumer. Fetched but unacknowledged events of its group are delivered again.
+func (q *MemoryQueue) Close(_ context.Context) error {
+	q.closeOnce.Do(func() {
+		q.topic.mu.Lock()
+		defer q.topic.mu.Unlock()
+
+		close(q.closed)
+
+		g := q.topic.group(q.opts.Group)
+		copy(g.fetched, g.committed)
+	})
+
+	return nil
+}
+
+// nextEvent returns the next unfetched event of the group, visiting partitions in round-robin order.
+// Must be called with the topic lock held.
+func (q *MemoryQueue) nextEvent() (Event, bool) {
+	g := q.topic.group(q.opts.Group)
+	n := len(q.topic.partitions)
+
+	for i := 0; i < n; i++ {
+		p := (g.next + i) % n
+		part := q.topic.partitions[p]
+		if g.fetched[p] >= part.base+int64(len(part.events)) {
+			continue
+		}
+
+		evt := part.events[g.fetched[p]-part.base]
+		g.fetched[p]++
+		g.next = (p + 1) % n
+
+		evt.Key = bytes.Clone(evt.Key)
+		evt.Value = bytes.Clone(evt.Value)
+		evt.Headers = maps.Clone(evt.Headers)
+
+		return evt, true
+	}
+
+	return Event{}, false
+}
+
+// partitionFor picks the partition by key hash and falls back to round robin for empty keys.
+// Must be called with the topic lock held.
+func (q *MemoryQueue) partitionFor(key []byte) int {
+	n := len(q.topic.partitions)
+
+	if len(key) == 0 {
+		p := q.topic.nextRR % n
+		q.topic.nextRR++
+		return p
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
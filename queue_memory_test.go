@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestMemoryQueue(t *testing.T, partitions int) *MemoryQueue {
+	t.Helper()
+
+	q, err := NewMemoryQueue(context.Background(), newTestLogger(), MemoryQueueOptions{
+		Topic:      "messages",
+		Partitions: partitions,
+		Group:      "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = q.Close(context.Background()) })
+
+	return q
+}
+
+func TestParseMemoryQueueOptions(t *testing.T) {
+	opts, err := ParseMemoryQueueOptions("memory://?partitions=4&group=workers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Partitions != 4 || opts.Group != "workers" {
+		t.Fatalf("got %+v", opts)
+	}
+
+	opts, err = ParseMemoryQueueOptions("memory://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Partitions != 1 || opts.Group != "msg-processor" {
+		t.Fatalf("got %+v, want the defaults", opts)
+	}
+
+	if _, err := ParseMemoryQueueOptions("memory://?partitions=many"); err == nil {
+		t.Fatal("expected an error for invalid partitions")
+	}
+}
+
+func TestMemoryQueueKeepsOrderOfKey(t *testing.T) {
+	ctx := newTestContext(t)
+	q := newTestMemoryQueue(t, 4)
+
+	for i := 0; i < 20; i++ {
+		key := []byte(strconv.Itoa(i % 3))
+		if err := q.WriteEvents(ctx, NewEvent(key, []byte(strconv.Itoa(i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	partitions := make(map[string]int)
+	last := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		evt, err := q.FetchEvent(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := string(evt.Key)
+		if p, ok := partitions[key]; ok && p != evt.Partition {
+			t.Fatalf("key %s is in partitions %d and %d", key, p, evt.Partition)
+		}
+		partitions[key] = evt.Partition
+
+		value, _ := strconv.Atoi(string(evt.Value))
+		if prev, ok := last[key]; ok && value < prev {
+			t.Fatalf("key %s: event %d is fetched after %d", key, value, prev)
+		}
+		last[key] = value
+	}
+}
+
+func TestMemoryQueueDropsAcknowledgedEvents(t *testing.T) {
+	ctx := newTestContext(t)
+	q := newTestMemoryQueue(t, 1)
+
+	for i := 0; i < 3; i++ {
+		if err := q.WriteEvents(ctx, NewEvent(nil, []byte(strconv.Itoa(i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evts := make([]Event, 0, 3)
+	for i := 0; i < 3; i++ {
+		evt, err := q.FetchEvent(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		evts = append(evts, evt)
+	}
+
+	if err := q.AckEvents(ctx, evts[1]); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(q.topic.partitions[0].events); got != 1 {
+		t.Fatalf("kept %d events, want 1 after acknowledging the second offset", got)
+	}
+
+	// Offsets keep growing after the acknowledged events are dropped.
+	if err := q.WriteEvents(ctx, NewEvent(nil, []byte("3"))); err != nil {
+		t.Fatal(err)
+	}
+	evt, err := q.FetchEvent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt.Offset != 3 {
+		t.Fatalf("got offset %d, want 3", evt.Offset)
+	}
+
+	if err := q.AckEvents(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(q.topic.partitions[0].events); got != 0 {
+		t.Fatalf("kept %d events, want none", got)
+	}
+}
+
+func TestMemoryQueueDeliversEveryEventToEachGroup(t *testing.T) {
+	ctx := newTestContext(t)
+	q := newTestMemoryQueue(t, 2)
+	other := q.WithGroup("other")
+	t.Cleanup(func() { _ = other.Close(context.Background()) })
+
+	for i := 0; i < 4; i++ {
+		if err := q.WriteEvents(ctx, NewEvent(nil, []byte(strconv.Itoa(i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, group := range []*MemoryQueue{q, other} {
+		got := make(map[string]bool)
+		for i := 0; i < 4; i++ {
+			evt, err := group.FetchEvent(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[string(evt.Value)] = true
+
+			if err := group.AckEvents(ctx, evt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(got) != 4 {
+			t.Fatalf("group %s got %d distinct events, want 4", group.opts.Group, len(got))
+		}
+
+		fetchCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		_, err := group.FetchEvent(fetchCtx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("group %s: got %v, want no more events", group.opts.Group, err)
+		}
+	}
+}
+
+func TestMemoryQueueKeepsEventsUntilEveryGroupAcknowledges(t *testing.T) {
+	ctx := newTestContext(t)
+	q := newTestMemoryQueue(t, 1)
+	other := q.WithGroup("other")
+	t.Cleanup(func() { _ = other.Close(context.Background()) })
+
+	if err := q.WriteEvents(ctx, NewEvent(nil, []byte("0"))); err != nil {
+		t.Fatal(err)
+	}
+
+	evt, err := q.ReadEvent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(q.topic.partitions[0].events); got != 1 {
+		t.Fatalf("kept %d events, want 1 until the other group acknowledges it", got)
+	}
+
+	if _, err := other.ReadEvent(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(q.topic.partitions[0].events); got != 0 {
+		t.Fatalf("kept %d events after offset %d is acknowledged by every group, want none", got, evt.Offset)
+	}
+}
+
+func TestMemoryQueueNackDoesNotRewindCommitted(t *testing.T) {
+	ctx := newTestContext(t)
+	q := newTestMemoryQueue(t, 1)
+
+	for i := 0; i < 3; i++ {
+		if err := q.WriteEvents(ctx, NewEvent(nil, []byte(strconv.Itoa(i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evts := make([]Event, 0, 3)
+	for i := 0; i < 3; i++ {
+		evt, err := q.FetchEvent(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		evts = append(evts, evt)
+	}
+
+	if err := q.AckEvents(ctx, evts[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.NackEvents(ctx, evts...); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range evts[1:] {
+		evt, err := q.FetchEvent(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if evt.Offset != want.Offset {
+			t.Fatalf("got offset %d, want %d", evt.Offset, want.Offset)
+		}
+	}
+}
+
+func TestMemoryQueueClose(t *testing.T) {
+	ctx := newTestContext(t)
+	q := newTestMemoryQueue(t, 1)
+
+	fetchErr := make(chan error, 1)
+	go func() {
+		_, err := q.FetchEvent(ctx)
+		fetchErr <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := q.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-fetchErr:
+		if !errors.Is(err, ErrQueueClosed) {
+			t.Fatalf("got %v, want %v", err, ErrQueueClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fetch is not stopped by close")
+	}
+
+	if err := q.WriteEvents(ctx, NewEvent(nil, []byte("late"))); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("got %v, want %v", err, ErrQueueClosed)
+	}
+}
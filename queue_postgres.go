@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/protomem/msg-processor/pkg/ctxstore"
+)
+
+const (
+	PgQueueScheme = "pg://"
+
+	_pgQueueNotifyChannel = "queue_events"
+)
+
+var _ Queue = (*PgQueue)(nil)
+
+type PgQueueOptions struct {
+	Topic string
+
+	// VisibilityTimeout is the time a fetched event is hidden from other consumers.
+	// An event that is not acknowledged in time is delivered again.
+	VisibilityTimeout time.Duration
+	// PollInterval is the interval of polling for new and expired events between notifications.
+	PollInterval time.Duration
+}
+
+// ParsePgQueueOptions parses addresses like "pg://?visibility_timeout=30s&poll_interval=1s".
+func ParsePgQueueOptions(addrs string) (PgQueueOptions, error) {
+	opts := PgQueueOptions{
+		VisibilityTimeout: 30 * time.Second,
+		PollInterval:      time.Second,
+	}
+
+	u, err := url.Parse(addrs)
+	if err != nil {
+		return PgQueueOptions{}, err
+	}
+
+	query := u.Query()
+	if v := query.Get("visibility_timeout"); v != "" {
+		if opts.VisibilityTimeout, err = time.ParseDuration(v); err != nil {
+			return PgQueueOptions{}, err
+		}
+	}
+	if v := query.Get("poll_interval"); v != "" {
+		if opts.PollInterval, err = time.ParseDuration(v); err != nil {
+			return PgQueueOptions{}, err
+		}
+	}
+
+	if opts.VisibilityTimeout <= 0 || opts.PollInterval <= 0 {
+		return PgQueueOptions{}, fmt.Errorf("invalid postgres queue options %q", addrs)
+	}
+
+	return opts, nil
+}
+
+// PgQueue keeps the events in the queue_events table of the storage database.
+// All consumers of a topic share its events like a single consumer group,
+// an event is locked by SELECT ... FOR UPDATE SKIP LOCKED and deleted on acknowledgement.
+// Every fetch locks a single event, so the visibility timeout of an event starts when it is returned.
+type PgQueue struct {
+	opts PgQueueOptions
+	log  *slog.Logger
+	db   *sql.DB
+
+	// The listener holds a connection, so it is started on the first fetch to keep write-only queues without it.
+	listenOnce sync.Once
+	listenDone chan struct{}
+	wakeup     chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func NewPgQueue(_ context.Context, log *slog.Logger, store *PgStorage, opts PgQueueOptions) (*PgQueue, error) {
+	return &PgQueue{
+		opts: opts,
+		log:  log.With("component", "pgQueue", "topic", opts.Topic),
+		db:   store.db,
+
+		listenDone: make(chan struct{}),
+		wakeup:     make(chan struct{}, 1),
+
+		closed: make(chan struct{}),
+	}, nil
+}
+
+func (q *PgQueue) WriteEvents(ctx context.Context, events ...Event) error {
+	log := q.log.With(
+		"query", "writeEvents",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	keys := make([][]byte, 0, len(events))
+	values := make([][]byte, 0, len(events))
+	headers := make([]string, 0, len(events))
+	contentTypes := make([]string, 0, len(events))
+	createdAts := make([]time.Time, 0, len(events))
+	for _, evt := range events {
+		evtHeaders, err := json.Marshal(evt.Headers)
+		if err != nil {
+			return err
+		}
+		if evt.Headers == nil {
+			evtHeaders = []byte("{}")
+		}
+
+		createdAt := evt.Tstamp
+		if createdAt.IsZero() {
+			createdAt = time.Now()
+		}
+
+		keys = append(keys, evt.Key)
+		values = append(values, evt.Value)
+		headers = append(headers, string(evtHeaders))
+		contentTypes = append(contentTypes, evt.ContentType)
+		createdAts = append(createdAts, createdAt)
+	}
+
+	// The notification is delivered on commit, together with the events.
+	query := `
+		WITH inserted AS (
+			INSERT INTO queue_events (topic, key, value, headers, content_type, created_at)
+			SELECT $1::text, t.key, t.value, t.headers, t.content_type, t.created_at
+			FROM unnest($2::bytea[], $3::bytea[], $4::jsonb[], $5::text[], $6::timestamptz[])
+				WITH ORDINALITY AS t(key, value, headers, content_type, created_at, ord)
+			ORDER BY t.ord
+			RETURNING id
+		)
+		SELECT pg_notify($7::text, $1::text) FROM (SELECT COUNT(*) FROM inserted) AS c
+	`
+
+	args := []any{q.opts.Topic, keys, values, headers, contentTypes, createdAts, _pgQueueNotifyChannel}
+
+	log.Debug("build query", "sql", query, "countEvents", len(events))
+
+	if _, err := q.db.ExecContext(ctx, query, args...); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return err
+	}
+
+	log.Debug("executed query", "countEvents", len(events))
+
+	return nil
+}
+
+func (q *PgQueue) ReadEvent(ctx context.Context) (Event, error) {
+	evt, err := q.FetchEvent(ctx)
+	if err != nil {
+		return Event{}, err
+	}
+
+	if err := q.AckEvents(ctx, evt); err != nil {
+		return Event{}, err
+	}
+
+	return evt, nil
+}
+
+func (q *PgQueue) FetchEvent(ctx context.Context) (Event, error) {
+	log := q.log.With(TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey))
+
+	q.listenOnce.Do(func() { go q.listen() })
+
+	poll := time.NewTimer(0)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-q.closed:
+			return Event{}, ErrQueueClosed
+		case <-ctx.Done():
+			log.Debug("failed to fetch event", "error", ctx.Err())
+
+			return Event{}, ctx.Err()
+		case <-q.wakeup:
+		case <-poll.C:
+		}
+
+		evt, ok, err := q.lockEvent(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return Event{}, ctx.Err()
+			}
+
+			log.Debug("failed to fetch event", "error", err)
+
+			return Event{}, err
+		}
+		if ok {
+			log.Debug("fetched event", "offset", evt.Offset)
+
+			return evt, nil
+		}
+
+		poll.Reset(q.opts.PollInterval)
+	}
+}
+
+// lockEvent locks the next pending event for the visibility timeout.
+func (q *PgQueue) lockEvent(ctx context.Context) (Event, bool, error) {
+	log := q.log.With(
+		"query", "lockEvent",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	query := `
+		UPDATE queue_events
+		SET locked_until = NOW() + $2 * INTERVAL '1 millisecond',
+			deliveries = deliveries + 1
+		WHERE id = (
+			SELECT id
+			FROM queue_events
+			WHERE topic = $1 AND (locked_until IS NULL OR locked_until < NOW())
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, created_at, key, value, headers, content_type
+	`
+
+	args := []any{q.opts.Topic, q.opts.VisibilityTimeout.Milliseconds()}
+
+	log.Debug("build query", "sql", query, "args", args)
+
+	var (
+		evt     Event
+		headers []byte
+	)
+	row := q.db.QueryRowContext(ctx, query, args...)
+	if err := row.Scan(&evt.Offset, &evt.Tstamp, &evt.Key, &evt.Value, &headers, &evt.ContentType); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Debug("executed query", "countEvents", 0)
+
+			return Event{}, false, nil
+		}
+
+		log.Debug("failed to execute query", "error", err)
+
+		return Event{}, false, err
+	}
+	if err := json.Unmarshal(headers, &evt.Headers); err != nil {
+		return Event{}, false, err
+	}
+	if len(evt.Headers) == 0 {
+		evt.Headers = nil
+	}
+	evt.Topic = q.opts.Topic
+
+	log.Debug("executed query", "countEvents", 1)
+
+	return evt, true, nil
+}
+
+func (q *PgQueue) VisibilityTimeout() time.Duration {
+	return q.opts.VisibilityTimeout
+}
+
+// acksIndividually marks the queue as individualAcker: an acknowledgement deletes only the given events.
+func (q *PgQueue) acksIndividually() {}
+
+func (q *PgQueue) AckEvents(ctx context.Context, events ...Event) error {
+	log := q.log.With(
+		"query", "ackEvents",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(events))
+	for _, evt := range events {
+		ids = append(ids, evt.Offset)
+	}
+
+	query := `
+		DELETE FROM queue_events
+		WHERE topic = $1 AND id = ANY($2::bigint[])
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{q.opts.Topic, ids})
+
+	if _, err := q.db.ExecContext(ctx, query, q.opts.Topic, ids); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return err
+	}
+
+	log.Debug("executed query", "countEvents", len(ids))
+
+	return nil
+}
+
+// NackEvents unlocks the events, so they are visible to the consumers again.
+func (q *PgQueue) NackEvents(ctx context.Context, events ...Event) error {
+	if err := q.releaseEvents(ctx, events); err != nil {
+		return err
+	}
+
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// listen wakes up fetching on notifications about new events of the topic until the queue is closed.
+func (q *PgQueue) listen() {
+	defer close(q.listenDone)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-q.closed
+		cancel()
+	}()
+
+	for {
+		err := q.waitNotifications(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		q.log.Warn("failed to listen for events", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(q.opts.PollInterval):
+		}
+	}
+}
+
+func (q *PgQueue) waitNotifications(ctx context.Context) error {
+	conn, err := q.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	return conn.Raw(func(driverConn any) error {
+		stdConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		pgxConn := stdConn.Conn()
+
+		if _, err := pgxConn.Exec(ctx, "LISTEN "+_pgQueueNotifyChannel); err != nil {
+			return err
+		}
+		defer func() {
+			// The connection returns to the pool, so it must stop listening.
+			_, _ = pgxConn.Exec(context.Background(), "UNLISTEN "+_pgQueueNotifyChannel)
+		}()
+
+		for {
+			notification, err := pgxConn.WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+
+			if notification.Payload != q.opts.Topic {
+				continue
+			}
+
+			select {
+			case q.wakeup <- struct{}{}:
+			default:
+			}
+		}
+	})
+}
+
+// Close stops fetching. Fetched but unacknowledged events are delivered again after the visibility timeout.
+func (q *PgQueue) Close(ctx context.Context) error {
+	var err error
+	q.closeOnce.Do(func() {
+		close(q.closed)
+
+		started := true
+		q.listenOnce.Do(func() { started = false })
+		if started {
+			select {
+			case <-q.listenDone:
+			case <-ctx.Done():
+				err = errors.Join(err, ctx.Err())
+			}
+		}
+	})
+	return err
+}
+
+func (q *PgQueue) releaseEvents(ctx context.Context, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(events))
+	for _, evt := range events {
+		ids = append(ids, evt.Offset)
+	}
+
+	query := `
+		UPDATE queue_events
+		SET locked_until = NULL
+		WHERE topic = $1 AND id = ANY($2::bigint[])
+	`
+
+	q.log.Debug("build query", "query", "releaseEvents", "sql", query, "args", []any{q.opts.Topic, ids})
+
+	if _, err := q.db.ExecContext(ctx, query, q.opts.Topic, ids); err != nil {
+		q.log.Debug("failed to execute query", "query", "releaseEvents", "error", err)
+
+		return err
+	}
+
+	return nil
+}
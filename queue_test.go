@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testQueue runs the behaviour tests every queue backend must pass.
+// newQueue creates a new queue with an empty topic.
+func testQueue(t *testing.T, newQueue func(t *testing.T) Queue) {
+	t.Run("FetchesEventsInOrderOfKey", func(t *testing.T) {
+		ctx := newTestQueueContext(t)
+		q := newQueue(t)
+
+		evts := make([]Event, 0, 3)
+		for i := 0; i < 3; i++ {
+			evt := NewEvent([]byte("key"), []byte(strconv.Itoa(i)))
+			evt.Headers = map[string]string{TraceIDHeader: "trace-" + strconv.Itoa(i)}
+			evt.ContentType = "text/plain"
+			evts = append(evts, evt)
+		}
+		if err := q.WriteEvents(ctx, evts...); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range evts {
+			evt, err := q.FetchEvent(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(evt.Value) != string(want.Value) || string(evt.Key) != string(want.Key) {
+				t.Fatalf("got event %s:%s, want %s:%s", evt.Key, evt.Value, want.Key, want.Value)
+			}
+			if evt.TraceID() != want.TraceID() || evt.ContentType != want.ContentType {
+				t.Fatalf("got headers %v and content type %q, want %v and %q",
+					evt.Headers, evt.ContentType, want.Headers, want.ContentType)
+			}
+
+			if err := q.AckEvents(ctx, evt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("DoesNotDeliverAcknowledgedEvents", func(t *testing.T) {
+		ctx := newTestQueueContext(t)
+		q := newQueue(t)
+
+		if err := q.WriteEvents(ctx, NewEvent([]byte("key"), []byte("0")), NewEvent([]byte("key"), []byte("1"))); err != nil {
+			t.Fatal(err)
+		}
+
+		evt, err := q.ReadEvent(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(evt.Value) != "0" {
+			t.Fatalf("got event %s, want 0", evt.Value)
+		}
+
+		evt, err = q.FetchEvent(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(evt.Value) != "1" {
+			t.Fatalf("got event %s, want 1", evt.Value)
+		}
+		if err := q.AckEvents(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+
+		expectNoEvent(t, ctx, q)
+	})
+
+	t.Run("RedeliversNackedEvents", func(t *testing.T) {
+		ctx := newTestQueueContext(t)
+		q := newQueue(t)
+
+		if err := q.WriteEvents(ctx, NewEvent([]byte("key"), []byte("0"))); err != nil {
+			t.Fatal(err)
+		}
+
+		evt, err := q.FetchEvent(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.NackEvents(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+
+		evt, err = q.FetchEvent(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(evt.Value) != "0" {
+			t.Fatalf("got event %s, want the nacked event 0", evt.Value)
+		}
+		if err := q.AckEvents(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+
+		expectNoEvent(t, ctx, q)
+	})
+
+	t.Run("StopsFetchOnClose", func(t *testing.T) {
+		ctx := newTestQueueContext(t)
+		q := newQueue(t)
+
+		fetchErr := make(chan error, 1)
+		go func() {
+			_, err := q.FetchEvent(ctx)
+			fetchErr <- err
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		if err := q.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-fetchErr:
+			if err == nil {
+				t.Fatal("got an event from the closed queue")
+			}
+		case <-ctx.Done():
+			t.Fatal("fetch is not stopped by close")
+		}
+	})
+}
+
+func newTestQueueContext(t *testing.T) context.Context {
+	t.Helper()
+
+	// Kafka consumers need a few seconds to join the group.
+	ctx, cancel := context.WithTimeout(newTestContext(t), 30*time.Second)
+	t.Cleanup(cancel)
+
+	return ctx
+}
+
+func expectNoEvent(t *testing.T, ctx context.Context, q Queue) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+
+	evt, err := q.FetchEvent(ctx)
+	if err == nil {
+		t.Fatalf("got event %s:%s, want no events", evt.Key, evt.Value)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+}
+
+func newTestTopic() string {
+	return "test-" + genTraceID()
+}
+
+func TestMemoryQueue(t *testing.T) {
+	testQueue(t, func(t *testing.T) Queue {
+		return newTestMemoryQueue(t, 2)
+	})
+}
+
+func TestFileQueue(t *testing.T) {
+	testQueue(t, func(t *testing.T) Queue {
+		opts, err := ParseFileQueueOptions(FileQueueScheme + t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Topic = newTestTopic()
+
+		q, err := NewFileQueue(context.Background(), newTestLogger(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = q.Close(context.Background()) })
+
+		return q
+	})
+}
+
+// TestPgQueue runs against the database in TEST_PG_DSN.
+func TestPgQueue(t *testing.T) {
+	dsn := os.Getenv("TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TEST_PG_DSN is not set")
+	}
+
+	store, err := NewPgStorage(context.Background(), newTestLogger(), PgStorageOptions{DSN: dsn, Ping: true, Automigrate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close(context.Background()) })
+
+	testQueue(t, func(t *testing.T) Queue {
+		q, err := NewPgQueue(context.Background(), newTestLogger(), store, PgQueueOptions{
+			Topic:             newTestTopic(),
+			VisibilityTimeout: 30 * time.Second,
+			PollInterval:      100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = q.Close(context.Background()) })
+
+		return q
+	})
+}
+
+// TestKafkaQueue runs against the brokers in TEST_KAFKA_ADDRS.
+func TestKafkaQueue(t *testing.T) {
+	addrs := os.Getenv("TEST_KAFKA_ADDRS")
+	if addrs == "" {
+		t.Skip("TEST_KAFKA_ADDRS is not set")
+	}
+
+	testQueue(t, func(t *testing.T) Queue {
+		q, err := NewKafkaQueue(context.Background(), newTestLogger(), KafkaQueueOptions{
+			Addrs: addrs,
+			Topic: newTestTopic(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = q.Close(context.Background()) })
+
+		return q
+	})
+}
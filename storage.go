@@ -2,15 +2,78 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 )
 
+var ErrConflict = errors.New("conflict")
+
+// ConstraintError is returned by storages when data violates a constraint of the schema.
+type ConstraintError struct {
+	Constraint string
+	Field      string
+	Message    string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("constraint %q violated: %s", e.Constraint, e.Message)
+}
+
 type Storage interface {
 	CountProcessingMessages(ctx context.Context) (count uint64, err error)
 	CountCompletedMessages(ctx context.Context) (count uint64, err error)
+	CountFailedMessages(ctx context.Context) (count uint64, err error)
+	CountDeadLetterMessages(ctx context.Context) (count uint64, err error)
 
 	GetMessage(ctx context.Context, id uint64) (msg Message, err error)
+	// ListMessages returns messages matching the filters, ordered by id and starting after the cursor id.
+	ListMessages(ctx context.Context, dto ListMessagesDTO) (msgs []Message, err error)
 	SaveMessage(ctx context.Context, dto SaveMessageDTO) (id uint64, err error)
+	// SaveMessages inserts all messages with their outbox events in one transaction.
+	// Messages are returned in the order of dtos.
+	SaveMessages(ctx context.Context, dtos []SaveMessageDTO) (msgs []Message, err error)
 	UpdateStatusMessages(ctx context.Context, ids []uint64, status MessageStatus) error
+	// CompleteMessages marks the messages completed and replaces their processing results in one transaction.
+	CompleteMessages(ctx context.Context, ids []uint64, results []ProcessingResult) error
+	// FailMessages increments attempts of the messages and records their errors.
+	// Messages that reached maxAttempts become dead_letter, others become failed and are published again.
+	// Messages already in dead_letter are left as is and returned with the new ones,
+	// so a failed dead-letter publish can be retried.
+	FailMessages(ctx context.Context, failures []MessageFailure, maxAttempts int) (deadLetterIds []uint64, err error)
+	// ReconcileStuckMessages takes up to limit messages left created or processing for longer than stuckAfter
+	// without a pending outbox event. They get a new outbox event to be published again,
+	// unless they were already reconciled maxAttempts times, then they become failed.
+	ReconcileStuckMessages(
+		ctx context.Context, stuckAfter time.Duration, limit uint64, maxAttempts int,
+	) (republishedIds []uint64, failedIds []uint64, err error)
+	// DeleteCompletedMessages locks up to limit messages completed longer than olderThan ago and passes them to fn.
+	// The messages are deleted with their processing results only if fn succeeds.
+	DeleteCompletedMessages(
+		ctx context.Context, olderThan time.Duration, limit uint64,
+		fn func(ctx context.Context, msgs []Message) error,
+	) (count uint64, err error)
+
+	// RelayOutboxEvents locks up to limit pending outbox events and passes them to fn.
+	// The events are marked sent and their created or failed messages become processing only if fn succeeds.
+	RelayOutboxEvents(ctx context.Context, limit uint64, fn func(ctx context.Context, events []OutboxEvent) error) (count uint64, err error)
+
+	GetProcessingResults(ctx context.Context, msgID uint64) (results []ProcessingResult, err error)
+
+	// SaveDeadLetters saves the dead letters, skipping the ones already saved for the same source event.
+	SaveDeadLetters(ctx context.Context, letters []DeadLetter) error
+	// ListDeadLetters returns dead letters ordered by id and starting after the cursor id.
+	ListDeadLetters(ctx context.Context, dto ListDeadLettersDTO) (letters []DeadLetter, err error)
+
+	// SaveIdempotentMessage saves the message with its outbox event and the idempotency key with the response
+	// made by respond in one transaction. A concurrent request with the same key waits for the transaction.
+	// If the key was saved less than ttl ago, nothing is saved and the existing key is returned with saved false.
+	SaveIdempotentMessage(
+		ctx context.Context, key, requestHash string, ttl time.Duration, dto SaveMessageDTO,
+		respond func(msg Message) (responseStatus int, responseBody []byte, err error),
+	) (existing IdempotencyKey, saved bool, err error)
+	// DeleteExpiredIdempotencyKeys deletes up to limit idempotency keys saved more than ttl ago.
+	DeleteExpiredIdempotencyKeys(ctx context.Context, ttl time.Duration, limit uint64) (count uint64, err error)
 
 	Close(ctx context.Context) error
 }
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/protomem/msg-processor/pkg/ctxstore"
+)
+
+const MemoryStorageScheme = "memory://"
+
+var _ Storage = (*MemoryStorage)(nil)
+
+type memoryOutboxEvent struct {
+	id        uint64
+	createdAt time.Time
+	sent      bool
+	locked    bool
+	msgID     uint64
+	traceID   string
+}
+
+type MemoryStorage struct {
+	log *slog.Logger
+
+	mu sync.Mutex
+
+	lastMsgID         uint64
+	msgs              map[uint64]Message
+	reconcileAttempts map[uint64]int
+	// traceIds keeps the trace id of the request that saved the message.
+	traceIds map[uint64]string
+
+	lastOutboxID uint64
+	outbox       []*memoryOutboxEvent
+
+	lastResultID uint64
+	results      map[uint64][]ProcessingResult
+
+	lastDeadLetterID  uint64
+	deadLetters       []DeadLetter
+	deadLetterSources map[deadLetterSource]struct{}
+
+	idempotencyKeys map[string]IdempotencyKey
+}
+
+func NewMemoryStorage(_ context.Context, log *slog.Logger) (*MemoryStorage, error) {
+	return &MemoryStorage{
+		log:  log.With("component", "memoryStorage"),
+		msgs: make(map[uint64]Message),
+
+		reconcileAttempts: make(map[uint64]int),
+		traceIds:          make(map[uint64]string),
+
+		results: make(map[uint64][]ProcessingResult),
+
+		deadLetterSources: make(map[deadLetterSource]struct{}),
+
+		idempotencyKeys: make(map[string]IdempotencyKey),
+	}, nil
+}
+
+func (s *MemoryStorage) Close(_ context.Context) error {
+	return nil
+}
+
+func (s *MemoryStorage) CountProcessingMessages(ctx context.Context) (uint64, error) {
+	return s.countMessages(ctx, "countProcessingMessages", MessageProcessing)
+}
+
+func (s *MemoryStorage) CountCompletedMessages(ctx context.Context) (uint64, error) {
+	return s.countMessages(ctx, "countCompletedMessages", MessageCompleted)
+}
+
+func (s *MemoryStorage) CountFailedMessages(ctx context.Context) (uint64, error) {
+	return s.countMessages(ctx, "countFailedMessages", MessageFailed)
+}
+
+func (s *MemoryStorage) CountDeadLetterMessages(ctx context.Context) (uint64, error) {
+	return s.countMessages(ctx, "countDeadLetterMessages", MessageDeadLetter)
+}
+
+func (s *MemoryStorage) countMessages(ctx context.Context, queryName string, status MessageStatus) (uint64, error) {
+	log := s.log.With(
+		"query", queryName,
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count uint64
+	for _, msg := range s.msgs {
+		if msg.Status == status {
+			count++
+		}
+	}
+
+	log.Debug("executed query", "count", count)
+
+	return count, nil
+}
+
+func (s *MemoryStorage) GetMessage(ctx context.Context, id uint64) (Message, error) {
+	log := s.log.With(
+		"query", "getMessage",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.msgs[id]
+	if !ok {
+		return Message{}, ErrMsgNotFound
+	}
+
+	log.Debug("executed query", "msgId", msg.ID)
+
+	return msg, nil
+}
+
+func (s *MemoryStorage) ListMessages(ctx context.Context, dto ListMessagesDTO) ([]Message, error) {
+	log := s.log.With(
+		"query", "listMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	text := strings.ToLower(dto.Text)
+	msgs := make([]Message, 0)
+	for _, msg := range s.msgs {
+		switch {
+		case dto.Status != "" && msg.Status != dto.Status:
+			continue
+		case !dto.CreatedFrom.IsZero() && msg.CreatedAt.Before(dto.CreatedFrom):
+			continue
+		case !dto.CreatedTo.IsZero() && !msg.CreatedAt.Before(dto.CreatedTo):
+			continue
+		case text != "" && !strings.Contains(strings.ToLower(msg.Text), text):
+			continue
+		case dto.Cursor != 0 && dto.Order == SortDesc && msg.ID >= dto.Cursor:
+			continue
+		case dto.Cursor != 0 && dto.Order != SortDesc && msg.ID <= dto.Cursor:
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+
+	slices.SortFunc(msgs, func(a, b Message) int {
+		if dto.Order == SortDesc {
+			return cmp.Compare(b.ID, a.ID)
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	if uint64(len(msgs)) > dto.Limit {
+		msgs = msgs[:dto.Limit]
+	}
+
+	log.Debug("executed query", "countMsgs", len(msgs))
+
+	return msgs, nil
+}
+
+func (s *MemoryStorage) SaveMessage(ctx context.Context, dto SaveMessageDTO) (uint64, error) {
+	log := s.log.With(
+		"query", "saveMessage",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	msgs, err := s.saveMessages(ctxstore.MustFrom[string](ctx, TraceIDKey), []SaveMessageDTO{dto})
+	if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return 0, err
+	}
+
+	log.Debug("executed query", "result", msgs[0].ID)
+
+	return msgs[0].ID, nil
+}
+
+func (s *MemoryStorage) SaveMessages(ctx context.Context, dtos []SaveMessageDTO) ([]Message, error) {
+	log := s.log.With(
+		"query", "saveMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	msgs, err := s.saveMessages(ctxstore.MustFrom[string](ctx, TraceIDKey), dtos)
+	if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, err
+	}
+
+	log.Debug("executed query", "countMsgs", len(msgs))
+
+	return msgs, nil
+}
+
+func (s *MemoryStorage) saveMessages(traceID string, dtos []SaveMessageDTO) ([]Message, error) {
+	for _, dto := range dtos {
+		if len(dto.Text) == 0 {
+			return nil, ErrMsgEmptyText
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	msgs := make([]Message, 0, len(dtos))
+	for _, dto := range dtos {
+		msg := s.newMessage(now, dto)
+		s.addMessage(traceID, msg)
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// newMessage allocates the id of a new message. Must be called with the lock held.
+func (s *MemoryStorage) newMessage(now time.Time, dto SaveMessageDTO) Message {
+	s.lastMsgID++
+	return Message{
+		ID:         s.lastMsgID,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Text:       dto.Text,
+		RoutingKey: dto.RoutingKey,
+		Status:     MessageCreated,
+	}
+}
+
+// addMessage stores the message with its outbox event. Must be called with the lock held.
+func (s *MemoryStorage) addMessage(traceID string, msg Message) {
+	s.msgs[msg.ID] = msg
+	s.traceIds[msg.ID] = traceID
+
+	s.lastOutboxID++
+	s.outbox = append(s.outbox, &memoryOutboxEvent{
+		id:        s.lastOutboxID,
+		createdAt: msg.CreatedAt,
+		msgID:     msg.ID,
+		traceID:   traceID,
+	})
+}
+
+func (s *MemoryStorage) UpdateStatusMessages(ctx context.Context, ids []uint64, status MessageStatus) error {
+	log := s.log.With(
+		"query", "updateStatusMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	if !status.Valid() {
+		err := fmt.Errorf("invalid message status %q", status)
+		log.Debug("failed to execute query", "error", err)
+
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var countRows int
+	for _, id := range ids {
+		msg, ok := s.msgs[id]
+		if !ok {
+			continue
+		}
+
+		msg.Status = status
+		msg.UpdatedAt = time.Now()
+		s.msgs[id] = msg
+		countRows++
+	}
+
+	log.Debug("executed query", "updatedRows", countRows)
+
+	return nil
+}
+
+func (s *MemoryStorage) CompleteMessages(ctx context.Context, ids []uint64, results []ProcessingResult) error {
+	log := s.log.With(
+		"query", "completeMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, res := range results {
+		if _, ok := s.msgs[res.MessageID]; !ok {
+			return &ConstraintError{Constraint: "processing_results_message_id_fkey", Field: "message_id", Message: "message does not exist"}
+		}
+	}
+
+	for _, id := range ids {
+		msg, ok := s.msgs[id]
+		if !ok {
+			continue
+		}
+
+		msg.Status = MessageCompleted
+		msg.UpdatedAt = time.Now()
+		s.msgs[id] = msg
+		delete(s.results, id)
+	}
+
+	for _, res := range results {
+		s.lastResultID++
+		res.ID = s.lastResultID
+		res.Result = slices.Clone(res.Result)
+		s.results[res.MessageID] = append(s.results[res.MessageID], res)
+	}
+
+	log.Debug("executed query", "countMsgs", len(ids), "countResults", len(results))
+
+	return nil
+}
+
+func (s *MemoryStorage) GetProcessingResults(ctx context.Context, msgID uint64) ([]ProcessingResult, error) {
+	log := s.log.With(
+		"query", "getProcessingResults",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := slices.Clone(s.results[msgID])
+	if results == nil {
+		results = make([]ProcessingResult, 0)
+	}
+
+	log.Debug("executed query", "countResults", len(results))
+
+	return results, nil
+}
+
+func (s *MemoryStorage) FailMessages(ctx context.Context, failures []MessageFailure, maxAttempts int) ([]uint64, error) {
+	log := s.log.With(
+		"query", "failMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	deadLetterIds := make([]uint64, 0)
+	for _, failure := range failures {
+		msg, ok := s.msgs[failure.MessageID]
+		if !ok {
+			continue
+		}
+		if msg.Status == MessageDeadLetter {
+			deadLetterIds = append(deadLetterIds, msg.ID)
+			continue
+		}
+
+		msg.Attempts++
+		msg.LastError = failure.Error
+		msg.UpdatedAt = now
+		if msg.Attempts >= maxAttempts {
+			msg.Status = MessageDeadLetter
+			deadLetterIds = append(deadLetterIds, msg.ID)
+		} else {
+			msg.Status = MessageFailed
+
+			s.lastOutboxID++
+			s.outbox = append(s.outbox, &memoryOutboxEvent{
+				id:        s.lastOutboxID,
+				createdAt: now,
+				msgID:     msg.ID,
+				traceID:   failure.TraceID,
+			})
+		}
+		s.msgs[msg.ID] = msg
+	}
+
+	log.Debug("executed query", "countMsgs", len(failures), "countDeadLetter", len(deadLetterIds))
+
+	return deadLetterIds, nil
+}
+
+func (s *MemoryStorage) ReconcileStuckMessages(
+	ctx context.Context, stuckAfter time.Duration, limit uint64, maxAttempts int,
+) ([]uint64, []uint64, error) {
+	traceID := ctxstore.MustFrom[string](ctx, TraceIDKey)
+	log := s.log.With(
+		"query", "reconcileStuckMessages",
+		TraceIDKey.String(), traceID,
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := make(map[uint64]bool)
+	for _, evt := range s.outbox {
+		if !evt.sent {
+			pending[evt.msgID] = true
+		}
+	}
+
+	now := time.Now()
+	deadline := now.Add(-stuckAfter)
+
+	stuck := make([]Message, 0)
+	for _, msg := range s.msgs {
+		switch {
+		case msg.Status != MessageCreated && msg.Status != MessageProcessing:
+			continue
+		case !msg.UpdatedAt.Before(deadline) || pending[msg.ID]:
+			continue
+		}
+		stuck = append(stuck, msg)
+	}
+
+	slices.SortFunc(stuck, func(a, b Message) int { return cmp.Compare(a.ID, b.ID) })
+	if uint64(len(stuck)) > limit {
+		stuck = stuck[:limit]
+	}
+
+	republishedIds := make([]uint64, 0)
+	failedIds := make([]uint64, 0)
+	for _, msg := range stuck {
+		id := msg.ID
+		if s.reconcileAttempts[id] >= maxAttempts {
+			msg.Status = MessageFailed
+			msg.LastError = ErrMsgStuck.Error()
+			failedIds = append(failedIds, id)
+		} else {
+			// A republished event continues the trace of the request that saved the message.
+			msgTraceID := s.traceIds[id]
+			if msgTraceID == "" {
+				msgTraceID = traceID
+			}
+
+			s.lastOutboxID++
+			s.outbox = append(s.outbox, &memoryOutboxEvent{
+				id:        s.lastOutboxID,
+				createdAt: now,
+				msgID:     id,
+				traceID:   msgTraceID,
+			})
+			republishedIds = append(republishedIds, id)
+		}
+
+		s.reconcileAttempts[id]++
+		msg.UpdatedAt = now
+		s.msgs[id] = msg
+	}
+
+	log.Debug("executed query", "countRepublished", len(republishedIds), "countFailed", len(failedIds))
+
+	return republishedIds, failedIds, nil
+}
+
+func (s *MemoryStorage) DeleteCompletedMessages(
+	ctx context.Context, olderThan time.Duration, limit uint64,
+	fn func(ctx context.Context, msgs []Message) error,
+) (uint64, error) {
+	log := s.log.With(
+		"query", "deleteCompletedMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	deadline := time.Now().Add(-olderThan)
+
+	s.mu.Lock()
+	msgs := make([]Message, 0)
+	for _, msg := range s.msgs {
+		if msg.Status == MessageCompleted && msg.UpdatedAt.Before(deadline) {
+			msgs = append(msgs, msg)
+		}
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(msgs, func(a, b Message) int { return cmp.Compare(a.ID, b.ID) })
+	if uint64(len(msgs)) > limit {
+		msgs = msgs[:limit]
+	}
+
+	if len(msgs) == 0 {
+		log.Debug("executed query", "countMsgs", 0)
+
+		return 0, nil
+	}
+
+	if err := fn(ctx, msgs); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count uint64
+	for _, msg := range msgs {
+		// The message could be updated while fn was running.
+		if cur, ok := s.msgs[msg.ID]; !ok || cur.Status != MessageCompleted {
+			continue
+		}
+
+		delete(s.msgs, msg.ID)
+		delete(s.results, msg.ID)
+		delete(s.reconcileAttempts, msg.ID)
+		delete(s.traceIds, msg.ID)
+		count++
+	}
+
+	s.outbox = slices.DeleteFunc(s.outbox, func(evt *memoryOutboxEvent) bool {
+		_, ok := s.msgs[evt.msgID]
+		return !ok
+	})
+	for i, letter := range s.deadLetters {
+		if _, ok := s.msgs[letter.MessageID]; !ok {
+			s.deadLetters[i].MessageID = 0
+		}
+	}
+	for key, idemKey := range s.idempotencyKeys {
+		if _, ok := s.msgs[idemKey.MessageID]; !ok {
+			idemKey.MessageID = 0
+			s.idempotencyKeys[key] = idemKey
+		}
+	}
+
+	log.Debug("executed query", "countMsgs", count)
+
+	return count, nil
+}
+
+func (s *MemoryStorage) RelayOutboxEvents(
+	ctx context.Context, limit uint64,
+	fn func(ctx context.Context, events []OutboxEvent) error,
+) (uint64, error) {
+	log := s.log.With(
+		"query", "relayOutboxEvents",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	locked := s.lockOutboxEvents(limit)
+	if len(locked) == 0 {
+		log.Debug("executed query", "countEvents", 0)
+
+		return 0, nil
+	}
+
+	s.mu.Lock()
+	events := make([]OutboxEvent, 0, len(locked))
+	for _, evt := range locked {
+		events = append(events, OutboxEvent{
+			ID:        evt.id,
+			CreatedAt: evt.createdAt,
+			TraceID:   evt.traceID,
+			Message:   s.msgs[evt.msgID],
+		})
+	}
+	s.mu.Unlock()
+
+	err := fn(ctx, events)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, evt := range locked {
+		evt.locked = false
+		if err != nil {
+			continue
+		}
+
+		evt.sent = true
+		if msg, ok := s.msgs[evt.msgID]; ok && (msg.Status == MessageCreated || msg.Status == MessageFailed) {
+			msg.Status = MessageProcessing
+			msg.UpdatedAt = time.Now()
+			s.msgs[evt.msgID] = msg
+		}
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	s.outbox = slices.DeleteFunc(s.outbox, func(evt *memoryOutboxEvent) bool {
+		return evt.sent
+	})
+
+	log.Debug("executed query", "countEvents", len(events))
+
+	return uint64(len(events)), nil
+}
+
+// lockOutboxEvents marks up to limit pending outbox events as locked,
+// skipping the ones already locked by a concurrent relay.
+func (s *MemoryStorage) lockOutboxEvents(limit uint64) []*memoryOutboxEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	locked := make([]*memoryOutboxEvent, 0)
+	for _, evt := range s.outbox {
+		if uint64(len(locked)) >= limit {
+			break
+		}
+		if evt.sent || evt.locked {
+			continue
+		}
+		if _, ok := s.msgs[evt.msgID]; !ok {
+			continue
+		}
+
+		evt.locked = true
+		locked = append(locked, evt)
+	}
+
+	return locked
+}
+
+func (s *MemoryStorage) SaveIdempotentMessage(
+	ctx context.Context,
+	key, requestHash string, ttl time.Duration, dto SaveMessageDTO,
+	respond func(msg Message) (responseStatus int, responseBody []byte, err error),
+) (IdempotencyKey, bool, error) {
+	log := s.log.With(
+		"query", "saveIdempotentMessage",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := s.idempotencyKeys[key]; ok && !existing.CreatedAt.Before(now.Add(-ttl)) {
+		log.Debug("executed query", "saved", false)
+
+		existing.ResponseBody = slices.Clone(existing.ResponseBody)
+		return existing, false, nil
+	}
+
+	if len(dto.Text) == 0 {
+		log.Debug("failed to execute query", "error", ErrMsgEmptyText)
+
+		return IdempotencyKey{}, false, ErrMsgEmptyText
+	}
+
+	// Nothing is stored until the response is built, so a failure leaves the key free.
+	msg := s.newMessage(now, dto)
+
+	responseStatus, responseBody, err := respond(msg)
+	if err != nil {
+		return IdempotencyKey{}, false, err
+	}
+
+	s.addMessage(ctxstore.MustFrom[string](ctx, TraceIDKey), msg)
+	s.idempotencyKeys[key] = IdempotencyKey{
+		Key:            key,
+		CreatedAt:      now,
+		RequestHash:    requestHash,
+		MessageID:      msg.ID,
+		ResponseStatus: responseStatus,
+		ResponseBody:   slices.Clone(responseBody),
+	}
+
+	log.Debug("executed query", "saved", true, "result", msg.ID)
+
+	return IdempotencyKey{}, true, nil
+}
+
+func (s *MemoryStorage) DeleteExpiredIdempotencyKeys(ctx context.Context, ttl time.Duration, limit uint64) (uint64, error) {
+	log := s.log.With(
+		"query", "deleteExpiredIdempotencyKeys",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiredBefore := time.Now().Add(-ttl)
+
+	var count uint64
+	for key, idemKey := range s.idempotencyKeys {
+		if count >= limit {
+			break
+		}
+		if !idemKey.CreatedAt.Before(expiredBefore) {
+			continue
+		}
+
+		delete(s.idempotencyKeys, key)
+		count++
+	}
+
+	log.Debug("executed query", "count", count)
+
+	return count, nil
+}
+
+func (s *MemoryStorage) SaveDeadLetters(ctx context.Context, letters []DeadLetter) error {
+	log := s.log.With(
+		"query", "saveDeadLetters",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var count int
+	for _, letter := range letters {
+		source := deadLetterSource{topic: letter.SourceTopic, partition: letter.SourcePartition, offset: letter.SourceOffset}
+		if _, ok := s.deadLetterSources[source]; ok {
+			continue
+		}
+		s.deadLetterSources[source] = struct{}{}
+		count++
+
+		s.lastDeadLetterID++
+		letter.ID = s.lastDeadLetterID
+		letter.CreatedAt = now
+		letter.Key = bytes.Clone(letter.Key)
+		letter.Value = bytes.Clone(letter.Value)
+		letter.Headers = maps.Clone(letter.Headers)
+
+		s.deadLetters = append(s.deadLetters, letter)
+	}
+
+	log.Debug("executed query", "countDeadLetters", count)
+
+	return nil
+}
+
+type deadLetterSource struct {
+	topic     string
+	partition int
+	offset    int64
+}
+
+func (s *MemoryStorage) ListDeadLetters(ctx context.Context, dto ListDeadLettersDTO) ([]DeadLetter, error) {
+	log := s.log.With(
+		"query", "listDeadLetters",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters := make([]DeadLetter, 0)
+	for _, letter := range s.deadLetters {
+		if uint64(len(letters)) >= dto.Limit {
+			break
+		}
+		if letter.ID <= dto.Cursor {
+			continue
+		}
+
+		letter.Key = bytes.Clone(letter.Key)
+		letter.Value = bytes.Clone(letter.Value)
+		letter.Headers = maps.Clone(letter.Headers)
+		letters = append(letters, letter)
+	}
+
+	log.Debug("executed query", "countDeadLetters", len(letters))
+
+	return letters, nil
+}
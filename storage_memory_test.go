@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/protomem/msg-processor/pkg/ctxstore"
+)
+
+func newTestMemoryStorage(t *testing.T) *MemoryStorage {
+	t.Helper()
+
+	s, err := NewMemoryStorage(context.Background(), newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// relayAll relays all pending outbox events and returns their messages.
+func relayAll(t *testing.T, ctx context.Context, s Storage) []Message {
+	t.Helper()
+
+	msgs := make([]Message, 0)
+	if _, err := s.RelayOutboxEvents(ctx, 100, func(_ context.Context, evts []OutboxEvent) error {
+		for _, evt := range evts {
+			msgs = append(msgs, evt.Message)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return msgs
+}
+
+func TestMemoryStorageSaveAndListMessages(t *testing.T) {
+	ctx := newTestContext(t)
+	s := newTestMemoryStorage(t)
+
+	if _, err := s.SaveMessage(ctx, SaveMessageDTO{}); !errors.Is(err, ErrMsgEmptyText) {
+		t.Fatalf("got %v, want %v", err, ErrMsgEmptyText)
+	}
+
+	msgs, err := s.SaveMessages(ctx, []SaveMessageDTO{
+		{Text: "Hello"},
+		{Text: "world", RoutingKey: "user-1"},
+		{Text: "hello again"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 || msgs[0].ID >= msgs[1].ID || msgs[1].ID >= msgs[2].ID {
+		t.Fatalf("got %+v, want 3 messages in order", msgs)
+	}
+
+	got, err := s.GetMessage(ctx, msgs[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != "world" || got.RoutingKey != "user-1" || got.Status != MessageCreated {
+		t.Fatalf("got %+v", got)
+	}
+
+	if _, err := s.GetMessage(ctx, 100); !errors.Is(err, ErrMsgNotFound) {
+		t.Fatalf("got %v, want %v", err, ErrMsgNotFound)
+	}
+
+	listed, err := s.ListMessages(ctx, ListMessagesDTO{Text: "hello", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].ID != msgs[0].ID || listed[1].ID != msgs[2].ID {
+		t.Fatalf("got %+v, want the messages containing hello", listed)
+	}
+
+	listed, err = s.ListMessages(ctx, ListMessagesDTO{Order: SortDesc, Cursor: msgs[2].ID, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != msgs[1].ID {
+		t.Fatalf("got %+v, want the message before the cursor", listed)
+	}
+}
+
+func TestMemoryStorageRelayOutboxEvents(t *testing.T) {
+	ctx := newTestContext(t)
+	s := newTestMemoryStorage(t)
+
+	ids := make([]uint64, 0, 2)
+	for _, text := range []string{"first", "second"} {
+		id, err := s.SaveMessage(ctx, SaveMessageDTO{Text: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// A failed publication leaves the events pending.
+	publishErr := errors.New("queue is unavailable")
+	if _, err := s.RelayOutboxEvents(ctx, 100, func(context.Context, []OutboxEvent) error {
+		return publishErr
+	}); !errors.Is(err, publishErr) {
+		t.Fatalf("got %v, want %v", err, publishErr)
+	}
+
+	relayed := relayAll(t, ctx, s)
+	if len(relayed) != len(ids) {
+		t.Fatalf("relayed %d events, want %d", len(relayed), len(ids))
+	}
+	if again := relayAll(t, ctx, s); len(again) != 0 {
+		t.Fatalf("relayed %d events again", len(again))
+	}
+
+	count, err := s.CountProcessingMessages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("got %d processing messages, want 2", count)
+	}
+}
+
+func TestMemoryStorageSaveIdempotentMessage(t *testing.T) {
+	ctx := newTestContext(t)
+	s := newTestMemoryStorage(t)
+
+	dto := SaveMessageDTO{Text: "one"}
+	respond := func(msg Message) (int, []byte, error) {
+		return 201, []byte(strconv.FormatUint(msg.ID, 10)), nil
+	}
+
+	// A failed response saves neither the message nor the key.
+	errRespond := errors.New("respond")
+	_, _, err := s.SaveIdempotentMessage(ctx, "key", "hash", time.Hour, dto, func(Message) (int, []byte, error) {
+		return 0, nil, errRespond
+	})
+	if !errors.Is(err, errRespond) {
+		t.Fatalf("got %v, want %v", err, errRespond)
+	}
+	if msgs := relayAll(t, ctx, s); len(msgs) != 0 {
+		t.Fatalf("got %d messages after a failed response, want none", len(msgs))
+	}
+
+	if _, saved, err := s.SaveIdempotentMessage(ctx, "key", "hash", time.Hour, dto, respond); err != nil || !saved {
+		t.Fatalf("got saved %v and %v, want the message saved", saved, err)
+	}
+	msgs := relayAll(t, ctx, s)
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+
+	existing, saved, err := s.SaveIdempotentMessage(ctx, "key", "other", time.Hour, dto, respond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved || !existing.Completed() || existing.RequestHash != "hash" || existing.MessageID != msgs[0].ID ||
+		existing.ResponseStatus != 201 || string(existing.ResponseBody) != strconv.FormatUint(msgs[0].ID, 10) {
+		t.Fatalf("got saved %v and %+v, want the saved response", saved, existing)
+	}
+
+	// An expired key is taken over by a new request.
+	if _, saved, err := s.SaveIdempotentMessage(ctx, "key", "hash", 0, dto, respond); err != nil || !saved {
+		t.Fatalf("got saved %v and %v, want the expired key taken over", saved, err)
+	}
+	if msgs := relayAll(t, ctx, s); len(msgs) != 1 {
+		t.Fatalf("got %d new messages, want 1", len(msgs))
+	}
+
+	if _, saved, err := s.SaveIdempotentMessage(ctx, "other", "hash", time.Hour, dto, respond); err != nil || !saved {
+		t.Fatalf("got saved %v and %v, want the message saved", saved, err)
+	}
+
+	// Only the keys older than ttl are deleted.
+	time.Sleep(10 * time.Millisecond)
+	if count, err := s.DeleteExpiredIdempotencyKeys(ctx, time.Hour, 10); err != nil || count != 0 {
+		t.Fatalf("deleted %d keys and %v, want none", count, err)
+	}
+	if count, err := s.DeleteExpiredIdempotencyKeys(ctx, 0, 1); err != nil || count != 1 {
+		t.Fatalf("deleted %d keys and %v, want 1", count, err)
+	}
+	if count, err := s.DeleteExpiredIdempotencyKeys(ctx, 0, 10); err != nil || count != 1 {
+		t.Fatalf("deleted %d keys and %v, want the last one", count, err)
+	}
+}
+
+func TestMemoryStorageCompleteAndFailMessages(t *testing.T) {
+	ctx := newTestContext(t)
+	s := newTestMemoryStorage(t)
+
+	msgs, err := s.SaveMessages(ctx, []SaveMessageDTO{{Text: "good"}, {Text: "bad"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayAll(t, ctx, s)
+
+	results := []ProcessingResult{{MessageID: msgs[0].ID, Processor: "length", Result: []byte(`{"length":4}`)}}
+	if err := s.CompleteMessages(ctx, []uint64{msgs[0].ID}, results); err != nil {
+		t.Fatal(err)
+	}
+
+	var constraintErr *ConstraintError
+	missing := []ProcessingResult{{MessageID: 100, Processor: "length", Result: []byte(`{}`)}}
+	if err := s.CompleteMessages(ctx, []uint64{100}, missing); !errors.As(err, &constraintErr) {
+		t.Fatalf("got %v, want a constraint error", err)
+	}
+
+	got, err := s.GetProcessingResults(ctx, msgs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Processor != "length" {
+		t.Fatalf("got %+v", got)
+	}
+
+	// The failed message is published again until it runs out of attempts.
+	for attempt := 1; attempt <= 2; attempt++ {
+		failures := []MessageFailure{{MessageID: msgs[1].ID, Error: "too short"}}
+		deadLetterIds, err := s.FailMessages(ctx, failures, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := s.GetMessage(ctx, msgs[1].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Attempts != attempt || msg.LastError != "too short" {
+			t.Fatalf("got %+v after attempt %d", msg, attempt)
+		}
+
+		if attempt < 2 {
+			if msg.Status != MessageFailed || len(deadLetterIds) != 0 {
+				t.Fatalf("got %s and dead letters %v, want a retry", msg.Status, deadLetterIds)
+			}
+			if retried := relayAll(t, ctx, s); len(retried) != 1 || retried[0].ID != msgs[1].ID {
+				t.Fatalf("retried %+v, want the failed message", retried)
+			}
+			continue
+		}
+
+		if msg.Status != MessageDeadLetter || len(deadLetterIds) != 1 {
+			t.Fatalf("got %s and dead letters %v, want a dead letter", msg.Status, deadLetterIds)
+		}
+		if retried := relayAll(t, ctx, s); len(retried) != 0 {
+			t.Fatalf("retried %+v after the last attempt", retried)
+		}
+	}
+
+	// A redelivered dead letter is returned again without counting another attempt.
+	failures := []MessageFailure{{MessageID: msgs[1].ID, Error: "again"}}
+	deadLetterIds, err := s.FailMessages(ctx, failures, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetterIds) != 1 || deadLetterIds[0] != msgs[1].ID {
+		t.Fatalf("got dead letters %v, want the message", deadLetterIds)
+	}
+
+	msg, err := s.GetMessage(ctx, msgs[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Status != MessageDeadLetter || msg.Attempts != 2 || msg.LastError != "too short" {
+		t.Fatalf("got %+v, want the dead letter unchanged", msg)
+	}
+}
+
+func TestMemoryStorageDeadLetters(t *testing.T) {
+	ctx := newTestContext(t)
+	s := newTestMemoryStorage(t)
+
+	letters := []DeadLetter{
+		{SourceTopic: "messages", SourceOffset: 1, Error: "bad", Value: []byte{0xff, 0xfe}},
+		{SourceTopic: "messages", SourceOffset: 2, Error: "bad", Value: []byte("two")},
+		{SourceTopic: "messages", SourceOffset: 3, Error: "bad", Value: []byte("three")},
+	}
+	if err := s.SaveDeadLetters(ctx, letters); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := s.ListDeadLetters(ctx, ListDeadLettersDTO{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].SourceOffset != 1 || !bytes.Equal(page[0].Value, []byte{0xff, 0xfe}) {
+		t.Fatalf("got %+v, want the first page", page)
+	}
+
+	page, err = s.ListDeadLetters(ctx, ListDeadLettersDTO{Cursor: page[1].ID, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].SourceOffset != 3 {
+		t.Fatalf("got %+v, want the last dead letter", page)
+	}
+
+	// A retry saves only the letters of new source events.
+	retried := []DeadLetter{letters[2], {SourceTopic: "messages", SourceOffset: 4, Error: "bad", Value: []byte("four")}}
+	if err := s.SaveDeadLetters(ctx, retried); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err = s.ListDeadLetters(ctx, ListDeadLettersDTO{Cursor: page[0].ID, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].SourceOffset != 4 {
+		t.Fatalf("got %+v, want only the new dead letter", page)
+	}
+}
+
+func TestMemoryStorageReconcileStuckMessages(t *testing.T) {
+	ctx := newTestContext(t)
+	s := newTestMemoryStorage(t)
+
+	msgs, err := s.SaveMessages(ctx, []SaveMessageDTO{{Text: "stuck"}, {Text: "done"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages with a pending outbox event are left to the relay.
+	republished, failed, err := s.ReconcileStuckMessages(ctx, 0, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(republished) != 0 || len(failed) != 0 {
+		t.Fatalf("got %v and %v, want nothing before the relay", republished, failed)
+	}
+
+	relayAll(t, ctx, s)
+	if err := s.CompleteMessages(ctx, []uint64{msgs[1].ID}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if republished, _, err := s.ReconcileStuckMessages(ctx, time.Hour, 10, 1); err != nil || len(republished) != 0 {
+		t.Fatalf("got %v and %v, want nothing stuck for an hour", republished, err)
+	}
+
+	// The republished event continues the trace of the request, not of the reconciler.
+	reconcileCtx := ctxstore.With(ctx, TraceIDKey, genTraceID())
+
+	time.Sleep(time.Millisecond)
+	republished, failed, err = s.ReconcileStuckMessages(reconcileCtx, 0, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(republished) != 1 || republished[0] != msgs[0].ID || len(failed) != 0 {
+		t.Fatalf("got %v and %v, want the stuck message republished", republished, failed)
+	}
+
+	var traceIds []string
+	if _, err := s.RelayOutboxEvents(ctx, 100, func(_ context.Context, evts []OutboxEvent) error {
+		for _, evt := range evts {
+			traceIds = append(traceIds, evt.TraceID)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if tid := ctxstore.MustFrom[string](ctx, TraceIDKey); len(traceIds) != 1 || traceIds[0] != tid {
+		t.Fatalf("got trace ids %v, want %s", traceIds, tid)
+	}
+
+	time.Sleep(time.Millisecond)
+	republished, failed, err = s.ReconcileStuckMessages(ctx, 0, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(republished) != 0 || len(failed) != 1 || failed[0] != msgs[0].ID {
+		t.Fatalf("got %v and %v, want the stuck message failed", republished, failed)
+	}
+
+	msg, err := s.GetMessage(ctx, msgs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Status != MessageFailed || msg.LastError != ErrMsgStuck.Error() {
+		t.Fatalf("got %+v", msg)
+	}
+}
+
+func TestMemoryStorageDeleteCompletedMessages(t *testing.T) {
+	ctx := newTestContext(t)
+	s := newTestMemoryStorage(t)
+
+	msgs, err := s.SaveMessages(ctx, []SaveMessageDTO{{Text: "one"}, {Text: "two"}, {Text: "three"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayAll(t, ctx, s)
+	if err := s.CompleteMessages(ctx, []uint64{msgs[0].ID, msgs[1].ID}, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	// A failed export keeps the messages.
+	exportErr := errors.New("disk is full")
+	if _, err := s.DeleteCompletedMessages(ctx, 0, 10, func(context.Context, []Message) error {
+		return exportErr
+	}); !errors.Is(err, exportErr) {
+		t.Fatalf("got %v, want %v", err, exportErr)
+	}
+
+	exported := make([]uint64, 0)
+	count, err := s.DeleteCompletedMessages(ctx, 0, 1, func(_ context.Context, batch []Message) error {
+		for _, msg := range batch {
+			exported = append(exported, msg.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || len(exported) != 1 || exported[0] != msgs[0].ID {
+		t.Fatalf("deleted %d and exported %v, want the first message", count, exported)
+	}
+
+	if _, err := s.GetMessage(ctx, msgs[0].ID); !errors.Is(err, ErrMsgNotFound) {
+		t.Fatalf("got %v, want %v", err, ErrMsgNotFound)
+	}
+	if _, err := s.GetMessage(ctx, msgs[2].ID); err != nil {
+		t.Fatalf("got %v, want the processing message kept", err)
+	}
+}
@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/protomem/msg-processor/assets"
 	"github.com/protomem/msg-processor/pkg/ctxstore"
 
@@ -17,6 +22,15 @@ import (
 
 const _pgDriverName = "pgx"
 
+const (
+	_pgNotNullViolationCode = "23502"
+	_pgUniqueViolationCode  = "23505"
+	_pgCheckViolationCode   = "23514"
+	_pgStringTooLongCode    = "22001"
+
+	_pgMessageTextConstraint = "messages_message_check"
+)
+
 var _ Storage = (*PgStorage)(nil)
 
 type PgStorageOptions struct {
@@ -128,6 +142,60 @@ func (s *PgStorage) CountCompletedMessages(ctx context.Context) (uint64, error)
 	return count, nil
 }
 
+func (s *PgStorage) CountFailedMessages(ctx context.Context) (uint64, error) {
+	log := s.log.With(
+		"query", "countFailedMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	query := `
+		SELECT COUNT(id)
+		FROM messages
+		WHERE status = $1
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{MessageFailed})
+
+	var count uint64
+	row := s.db.QueryRowContext(ctx, query, MessageFailed)
+	if err := row.Scan(&count); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return 0, err
+	}
+
+	log.Debug("executed query", "count", count)
+
+	return count, nil
+}
+
+func (s *PgStorage) CountDeadLetterMessages(ctx context.Context) (uint64, error) {
+	log := s.log.With(
+		"query", "countDeadLetterMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	query := `
+		SELECT COUNT(id)
+		FROM messages
+		WHERE status = $1
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{MessageDeadLetter})
+
+	var count uint64
+	row := s.db.QueryRowContext(ctx, query, MessageDeadLetter)
+	if err := row.Scan(&count); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return 0, err
+	}
+
+	log.Debug("executed query", "count", count)
+
+	return count, nil
+}
+
 func (s *PgStorage) GetMessage(ctx context.Context, id uint64) (Message, error) {
 	log := s.log.With(
 		"query", "getMessage",
@@ -135,7 +203,7 @@ func (s *PgStorage) GetMessage(ctx context.Context, id uint64) (Message, error)
 	)
 
 	query := `
-		SELECT id, created_at, updated_at, message, status
+		SELECT id, created_at, updated_at, message, routing_key, status, attempts, last_error
 		FROM messages
 		WHERE id = $1
 		LIMIT 1
@@ -145,7 +213,7 @@ func (s *PgStorage) GetMessage(ctx context.Context, id uint64) (Message, error)
 
 	var msg Message
 	row := s.db.QueryRowContext(ctx, query, id)
-	if err := row.Scan(&msg.ID, &msg.CreatedAt, &msg.UpdatedAt, &msg.Text, &msg.Status); err != nil {
+	if err := row.Scan(&msg.ID, &msg.CreatedAt, &msg.UpdatedAt, &msg.Text, &msg.RoutingKey, &msg.Status, &msg.Attempts, &msg.LastError); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Message{}, ErrMsgNotFound
 		}
@@ -160,25 +228,133 @@ func (s *PgStorage) GetMessage(ctx context.Context, id uint64) (Message, error)
 	return msg, nil
 }
 
+func (s *PgStorage) ListMessages(ctx context.Context, dto ListMessagesDTO) ([]Message, error) {
+	log := s.log.With(
+		"query", "listMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	var (
+		conds = make([]string, 0)
+		args  = make([]any, 0)
+	)
+	where := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if dto.Status != "" {
+		where("status = $%d", dto.Status)
+	}
+	if !dto.CreatedFrom.IsZero() {
+		where("created_at >= $%d", dto.CreatedFrom)
+	}
+	if !dto.CreatedTo.IsZero() {
+		where("created_at < $%d", dto.CreatedTo)
+	}
+	if dto.Text != "" {
+		where("strpos(lower(message), lower($%d)) > 0", dto.Text)
+	}
+
+	order := "ASC"
+	if dto.Order == SortDesc {
+		order = "DESC"
+		if dto.Cursor != 0 {
+			where("id < $%d", dto.Cursor)
+		}
+	} else if dto.Cursor != 0 {
+		where("id > $%d", dto.Cursor)
+	}
+
+	query := `
+		SELECT id, created_at, updated_at, message, routing_key, status, attempts, last_error
+		FROM messages
+	`
+	if len(conds) > 0 {
+		query += "WHERE " + strings.Join(conds, " AND ") + "\n"
+	}
+	args = append(args, dto.Limit)
+	query += fmt.Sprintf("ORDER BY id %s\nLIMIT $%d", order, len(args))
+
+	log.Debug("build query", "sql", query, "args", args)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	msgs := make([]Message, 0)
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.CreatedAt, &msg.UpdatedAt, &msg.Text, &msg.RoutingKey, &msg.Status, &msg.Attempts, &msg.LastError); err != nil {
+			log.Debug("failed to scan row", "error", err)
+
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, err
+	}
+
+	log.Debug("executed query", "countMsgs", len(msgs))
+
+	return msgs, nil
+}
+
 func (s *PgStorage) SaveMessage(ctx context.Context, dto SaveMessageDTO) (uint64, error) {
 	log := s.log.With(
 		"query", "saveMessage",
 		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
 	)
 
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Debug("failed to begin transaction", "error", err)
+
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	tid := ctxstore.MustFrom[string](ctx, TraceIDKey)
+
 	query := `
-		INSERT INTO messages (message)
-		VALUES ($1)
+		INSERT INTO messages (message, routing_key, trace_id)
+		VALUES ($1, $2, $3)
 		RETURNING id
 	`
 
-	log.Debug("build query", "sql", query, "args", []any{dto.Text})
+	log.Debug("build query", "sql", query, "args", []any{dto.Text, dto.RoutingKey, tid})
 
 	var id uint64
-	row := s.db.QueryRowContext(ctx, query, dto.Text)
+	row := tx.QueryRowContext(ctx, query, dto.Text, dto.RoutingKey, tid)
 	if err := row.Scan(&id); err != nil {
 		log.Debug("failed to execute query", "error", err)
 
+		return 0, pgTranslateError(err)
+	}
+
+	query = `
+		INSERT INTO outbox (message_id, trace_id)
+		VALUES ($1, $2)
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{id, tid})
+
+	if _, err := tx.ExecContext(ctx, query, id, tid); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Debug("failed to commit transaction", "error", err)
+
 		return 0, err
 	}
 
@@ -187,6 +363,99 @@ func (s *PgStorage) SaveMessage(ctx context.Context, dto SaveMessageDTO) (uint64
 	return id, nil
 }
 
+func (s *PgStorage) SaveMessages(ctx context.Context, dtos []SaveMessageDTO) ([]Message, error) {
+	log := s.log.With(
+		"query", "saveMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	if len(dtos) == 0 {
+		return []Message{}, nil
+	}
+
+	texts := make([]string, 0, len(dtos))
+	routingKeys := make([]string, 0, len(dtos))
+	for _, dto := range dtos {
+		texts = append(texts, dto.Text)
+		routingKeys = append(routingKeys, dto.RoutingKey)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Debug("failed to begin transaction", "error", err)
+
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	tid := ctxstore.MustFrom[string](ctx, TraceIDKey)
+
+	// Ids are assigned in the order of insertion, so sorting by id restores the order of dtos.
+	query := `
+		WITH inserted AS (
+			INSERT INTO messages (message, routing_key, trace_id)
+			SELECT t.message, t.routing_key, $3::text
+			FROM unnest($1::text[], $2::text[]) WITH ORDINALITY AS t(message, routing_key, ord)
+			ORDER BY t.ord
+			RETURNING id, created_at, updated_at, message, routing_key, status, attempts, last_error
+		)
+		SELECT id, created_at, updated_at, message, routing_key, status, attempts, last_error
+		FROM inserted
+		ORDER BY id
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{texts, routingKeys, tid})
+
+	rows, err := tx.QueryContext(ctx, query, texts, routingKeys, tid)
+	if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, pgTranslateError(err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	msgs := make([]Message, 0, len(dtos))
+	msgIds := make([]uint64, 0, len(dtos))
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.CreatedAt, &msg.UpdatedAt, &msg.Text, &msg.RoutingKey, &msg.Status, &msg.Attempts, &msg.LastError); err != nil {
+			log.Debug("failed to scan row", "error", err)
+
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+		msgIds = append(msgIds, msg.ID)
+	}
+	if err := rows.Err(); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, pgTranslateError(err)
+	}
+
+	query = `
+		INSERT INTO outbox (message_id, trace_id)
+		SELECT unnest($1::bigint[]), $2
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{msgIds, tid})
+
+	if _, err := tx.ExecContext(ctx, query, msgIds, tid); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Debug("failed to commit transaction", "error", err)
+
+		return nil, err
+	}
+
+	log.Debug("executed query", "countMsgs", len(msgs))
+
+	return msgs, nil
+}
+
 func (s *PgStorage) UpdateStatusMessages(ctx context.Context, ids []uint64, status MessageStatus) error {
 	log := s.log.With(
 		"query", "updateStatusMessages",
@@ -195,7 +464,7 @@ func (s *PgStorage) UpdateStatusMessages(ctx context.Context, ids []uint64, stat
 
 	query := `
 		UPDATE messages
-		SET status = $1
+		SET status = $1, updated_at = NOW()
 		WHERE id = ANY($2::bigint[])
 	`
 
@@ -205,7 +474,7 @@ func (s *PgStorage) UpdateStatusMessages(ctx context.Context, ids []uint64, stat
 	if err != nil {
 		log.Debug("failed to execute query", "error", err)
 
-		return err
+		return pgTranslateError(err)
 	}
 
 	countRows, err := res.RowsAffected()
@@ -217,3 +486,859 @@ func (s *PgStorage) UpdateStatusMessages(ctx context.Context, ids []uint64, stat
 
 	return nil
 }
+
+func (s *PgStorage) CompleteMessages(ctx context.Context, ids []uint64, results []ProcessingResult) error {
+	log := s.log.With(
+		"query", "completeMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Debug("failed to begin transaction", "error", err)
+
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	query := `
+		UPDATE messages
+		SET status = $1, updated_at = NOW()
+		WHERE id = ANY($2::bigint[])
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{MessageCompleted, ids})
+
+	if _, err := tx.ExecContext(ctx, query, MessageCompleted, ids); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return pgTranslateError(err)
+	}
+
+	// Results of previous deliveries of the same messages are replaced.
+	query = `
+		DELETE FROM processing_results
+		WHERE message_id = ANY($1::bigint[])
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{ids})
+
+	if _, err := tx.ExecContext(ctx, query, ids); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return err
+	}
+
+	if len(results) > 0 {
+		var (
+			msgIds      = make([]uint64, 0, len(results))
+			processors  = make([]string, 0, len(results))
+			outputs     = make([]string, 0, len(results))
+			durations   = make([]int64, 0, len(results))
+			finishedAts = make([]time.Time, 0, len(results))
+		)
+		for _, res := range results {
+			output := string(res.Result)
+			if output == "" {
+				output = "{}"
+			}
+
+			msgIds = append(msgIds, res.MessageID)
+			processors = append(processors, res.Processor)
+			outputs = append(outputs, output)
+			durations = append(durations, int64(res.Duration))
+			finishedAts = append(finishedAts, res.FinishedAt)
+		}
+
+		query = `
+			INSERT INTO processing_results (message_id, processor, result, duration_ns, finished_at)
+			SELECT *
+			FROM unnest($1::bigint[], $2::text[], $3::jsonb[], $4::bigint[], $5::timestamptz[])
+		`
+
+		log.Debug("build query", "sql", query, "args", []any{msgIds, processors, durations})
+
+		if _, err := tx.ExecContext(ctx, query, msgIds, processors, outputs, durations, finishedAts); err != nil {
+			log.Debug("failed to execute query", "error", err)
+
+			return pgTranslateError(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Debug("failed to commit transaction", "error", err)
+
+		return err
+	}
+
+	log.Debug("executed query", "countMsgs", len(ids), "countResults", len(results))
+
+	return nil
+}
+
+func (s *PgStorage) FailMessages(ctx context.Context, failures []MessageFailure, maxAttempts int) ([]uint64, error) {
+	log := s.log.With(
+		"query", "failMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	if len(failures) == 0 {
+		return []uint64{}, nil
+	}
+
+	ids := make([]uint64, 0, len(failures))
+	errs := make([]string, 0, len(failures))
+	traceIds := make([]string, 0, len(failures))
+	for _, failure := range failures {
+		ids = append(ids, failure.MessageID)
+		errs = append(errs, failure.Error)
+		traceIds = append(traceIds, failure.TraceID)
+	}
+
+	// Failed messages get a new outbox event to be processed again.
+	// Messages already in dead_letter are not updated, the last query sees them as before the update.
+	query := `
+		WITH failures AS (
+			SELECT id, error, trace_id
+			FROM unnest($1::bigint[], $2::text[], $6::text[]) AS f(id, error, trace_id)
+		), updated AS (
+			UPDATE messages m
+			SET attempts = m.attempts + 1,
+				last_error = f.error,
+				status = CASE WHEN m.attempts + 1 >= $3 THEN $4 ELSE $5 END,
+				updated_at = NOW()
+			FROM failures f
+			WHERE m.id = f.id AND m.status <> $4
+			RETURNING m.id, m.status, f.trace_id
+		), retried AS (
+			INSERT INTO outbox (message_id, trace_id)
+			SELECT id, trace_id FROM updated WHERE status = $5
+		)
+		SELECT id FROM updated WHERE status = $4
+		UNION ALL
+		SELECT m.id FROM messages m JOIN failures f ON m.id = f.id WHERE m.status = $4
+	`
+
+	args := []any{ids, errs, maxAttempts, MessageDeadLetter, MessageFailed, traceIds}
+
+	log.Debug("build query", "sql", query, "args", args)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, pgTranslateError(err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	deadLetterIds := make([]uint64, 0)
+	for rows.Next() {
+		var id uint64
+		if err := rows.Scan(&id); err != nil {
+			log.Debug("failed to scan row", "error", err)
+
+			return nil, err
+		}
+		deadLetterIds = append(deadLetterIds, id)
+	}
+	if err := rows.Err(); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, pgTranslateError(err)
+	}
+
+	log.Debug("executed query", "countMsgs", len(failures), "countDeadLetter", len(deadLetterIds))
+
+	return deadLetterIds, nil
+}
+
+func (s *PgStorage) ReconcileStuckMessages(
+	ctx context.Context, stuckAfter time.Duration, limit uint64, maxAttempts int,
+) ([]uint64, []uint64, error) {
+	traceID := ctxstore.MustFrom[string](ctx, TraceIDKey)
+	log := s.log.With(
+		"query", "reconcileStuckMessages",
+		TraceIDKey.String(), traceID,
+	)
+
+	// Messages with a pending outbox event are left to the relay.
+	// A republished event continues the trace of the request that saved the message.
+	query := `
+		WITH stuck AS (
+			SELECT m.id
+			FROM messages m
+			WHERE m.status = ANY($1::text[])
+				AND m.updated_at < NOW() - $2 * INTERVAL '1 second'
+				AND NOT EXISTS (SELECT 1 FROM outbox o WHERE o.message_id = m.id AND o.sent_at IS NULL)
+			ORDER BY m.id
+			LIMIT $3
+			FOR UPDATE OF m SKIP LOCKED
+		), updated AS (
+			UPDATE messages m
+			SET reconcile_attempts = m.reconcile_attempts + 1,
+				status = CASE WHEN m.reconcile_attempts >= $4 THEN $5 ELSE m.status END,
+				last_error = CASE WHEN m.reconcile_attempts >= $4 THEN $6 ELSE m.last_error END,
+				updated_at = NOW()
+			FROM stuck
+			WHERE m.id = stuck.id
+			RETURNING m.id, m.status, m.trace_id
+		), republished AS (
+			INSERT INTO outbox (message_id, trace_id)
+			SELECT id, COALESCE(NULLIF(trace_id, ''), $7) FROM updated WHERE status <> $5
+		)
+		SELECT id, status FROM updated ORDER BY id
+	`
+
+	stuckStatuses := []MessageStatus{MessageCreated, MessageProcessing}
+	args := []any{stuckStatuses, stuckAfter.Seconds(), limit, maxAttempts, MessageFailed, ErrMsgStuck.Error(), traceID}
+
+	log.Debug("build query", "sql", query, "args", args)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, nil, pgTranslateError(err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	republishedIds := make([]uint64, 0)
+	failedIds := make([]uint64, 0)
+	for rows.Next() {
+		var (
+			id     uint64
+			status MessageStatus
+		)
+		if err := rows.Scan(&id, &status); err != nil {
+			log.Debug("failed to scan row", "error", err)
+
+			return nil, nil, err
+		}
+
+		if status == MessageFailed {
+			failedIds = append(failedIds, id)
+		} else {
+			republishedIds = append(republishedIds, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, nil, pgTranslateError(err)
+	}
+
+	log.Debug("executed query", "countRepublished", len(republishedIds), "countFailed", len(failedIds))
+
+	return republishedIds, failedIds, nil
+}
+
+func (s *PgStorage) DeleteCompletedMessages(
+	ctx context.Context, olderThan time.Duration, limit uint64,
+	fn func(ctx context.Context, msgs []Message) error,
+) (uint64, error) {
+	log := s.log.With(
+		"query", "deleteCompletedMessages",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Debug("failed to begin transaction", "error", err)
+
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	query := `
+		SELECT id, created_at, updated_at, message, routing_key, status, attempts, last_error
+		FROM messages
+		WHERE status = $1 AND updated_at < NOW() - $2 * INTERVAL '1 second'
+		ORDER BY id
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED
+	`
+
+	args := []any{MessageCompleted, olderThan.Seconds(), limit}
+
+	log.Debug("build query", "sql", query, "args", args)
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return 0, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	msgs := make([]Message, 0)
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(
+			&msg.ID, &msg.CreatedAt, &msg.UpdatedAt, &msg.Text, &msg.RoutingKey, &msg.Status,
+			&msg.Attempts, &msg.LastError,
+		); err != nil {
+			log.Debug("failed to scan row", "error", err)
+
+			return 0, err
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return 0, err
+	}
+
+	if len(msgs) == 0 {
+		log.Debug("executed query", "countMsgs", 0)
+
+		return 0, nil
+	}
+
+	if err := fn(ctx, msgs); err != nil {
+		return 0, err
+	}
+
+	ids := make([]uint64, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+
+	// Outbox events and processing results are deleted by cascade.
+	query = `
+		DELETE FROM messages
+		WHERE id = ANY($1::bigint[])
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{ids})
+
+	if _, err := tx.ExecContext(ctx, query, ids); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return 0, pgTranslateError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Debug("failed to commit transaction", "error", err)
+
+		return 0, err
+	}
+
+	log.Debug("executed query", "countMsgs", len(msgs))
+
+	return uint64(len(msgs)), nil
+}
+
+func (s *PgStorage) RelayOutboxEvents(
+	ctx context.Context, limit uint64,
+	fn func(ctx context.Context, events []OutboxEvent) error,
+) (uint64, error) {
+	log := s.log.With(
+		"query", "relayOutboxEvents",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Debug("failed to begin transaction", "error", err)
+
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	query := `
+		SELECT o.id, o.created_at, o.trace_id, m.id, m.created_at, m.updated_at, m.message, m.routing_key, m.status, m.attempts, m.last_error
+		FROM outbox o
+		JOIN messages m ON m.id = o.message_id
+		WHERE o.sent_at IS NULL
+		ORDER BY o.id
+		LIMIT $1
+		FOR UPDATE OF o SKIP LOCKED
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{limit})
+
+	rows, err := tx.QueryContext(ctx, query, limit)
+	if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return 0, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	events := make([]OutboxEvent, 0)
+	for rows.Next() {
+		var evt OutboxEvent
+		if err := rows.Scan(
+			&evt.ID, &evt.CreatedAt, &evt.TraceID,
+			&evt.Message.ID, &evt.Message.CreatedAt, &evt.Message.UpdatedAt, &evt.Message.Text, &evt.Message.RoutingKey, &evt.Message.Status,
+			&evt.Message.Attempts, &evt.Message.LastError,
+		); err != nil {
+			log.Debug("failed to scan row", "error", err)
+
+			return 0, err
+		}
+		events = append(events, evt)
+	}
+	if err := rows.Err(); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return 0, err
+	}
+
+	if len(events) == 0 {
+		log.Debug("executed query", "countEvents", 0)
+
+		return 0, nil
+	}
+
+	if err := fn(ctx, events); err != nil {
+		return 0, err
+	}
+
+	evtIds := make([]uint64, 0, len(events))
+	msgIds := make([]uint64, 0, len(events))
+	for _, evt := range events {
+		evtIds = append(evtIds, evt.ID)
+		msgIds = append(msgIds, evt.Message.ID)
+	}
+
+	query = `
+		UPDATE outbox
+		SET sent_at = NOW()
+		WHERE id = ANY($1::bigint[])
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{evtIds})
+
+	if _, err := tx.ExecContext(ctx, query, evtIds); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return 0, err
+	}
+
+	query = `
+		UPDATE messages
+		SET status = $1, updated_at = NOW()
+		WHERE id = ANY($2::bigint[]) AND status = ANY($3::text[])
+	`
+
+	relayedStatuses := []MessageStatus{MessageCreated, MessageFailed}
+
+	log.Debug("build query", "sql", query, "args", []any{MessageProcessing, msgIds, relayedStatuses})
+
+	if _, err := tx.ExecContext(ctx, query, MessageProcessing, msgIds, relayedStatuses); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Debug("failed to commit transaction", "error", err)
+
+		return 0, err
+	}
+
+	log.Debug("executed query", "countEvents", len(events))
+
+	return uint64(len(events)), nil
+}
+
+func pgTranslateError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+
+	switch pgErr.Code {
+	case _pgCheckViolationCode:
+		if pgErr.ConstraintName == _pgMessageTextConstraint {
+			return ErrMsgEmptyText
+		}
+		return &ConstraintError{Constraint: pgErr.ConstraintName, Field: pgErr.ColumnName, Message: pgErr.Message}
+	case _pgNotNullViolationCode, _pgStringTooLongCode:
+		return &ConstraintError{Constraint: pgErr.ConstraintName, Field: pgErr.ColumnName, Message: pgErr.Message}
+	case _pgUniqueViolationCode:
+		return fmt.Errorf("%w: %s", ErrConflict, pgErr.Detail)
+	default:
+		return err
+	}
+}
+
+func (s *PgStorage) SaveIdempotentMessage(
+	ctx context.Context,
+	key, requestHash string, ttl time.Duration, dto SaveMessageDTO,
+	respond func(msg Message) (responseStatus int, responseBody []byte, err error),
+) (IdempotencyKey, bool, error) {
+	log := s.log.With(
+		"query", "saveIdempotentMessage",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Debug("failed to begin transaction", "error", err)
+
+		return IdempotencyKey{}, false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// The inserted key is locked until the end of the transaction, so a concurrent request with the same key waits here.
+	// Expired keys are taken over by the new request.
+	query := `
+		INSERT INTO idempotency_keys (key, request_hash)
+		VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE
+		SET created_at = NOW(), request_hash = EXCLUDED.request_hash,
+			message_id = NULL, response_status = NULL, response_body = NULL
+		WHERE idempotency_keys.created_at < NOW() - $3 * INTERVAL '1 second'
+		RETURNING key
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{key, requestHash, ttl.Seconds()})
+
+	var reservedKey string
+	row := tx.QueryRowContext(ctx, query, key, requestHash, ttl.Seconds())
+	if err := row.Scan(&reservedKey); errors.Is(err, sql.ErrNoRows) {
+		existing, err := s.getIdempotencyKey(ctx, log, tx, key)
+		if err != nil {
+			return IdempotencyKey{}, false, err
+		}
+
+		log.Debug("executed query", "saved", false)
+
+		return existing, false, nil
+	} else if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return IdempotencyKey{}, false, pgTranslateError(err)
+	}
+
+	tid := ctxstore.MustFrom[string](ctx, TraceIDKey)
+
+	query = `
+		INSERT INTO messages (message, routing_key, trace_id)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at, message, routing_key, status, attempts, last_error
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{dto.Text, dto.RoutingKey, tid})
+
+	var msg Message
+	row = tx.QueryRowContext(ctx, query, dto.Text, dto.RoutingKey, tid)
+	if err := row.Scan(
+		&msg.ID, &msg.CreatedAt, &msg.UpdatedAt, &msg.Text, &msg.RoutingKey, &msg.Status, &msg.Attempts, &msg.LastError,
+	); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return IdempotencyKey{}, false, pgTranslateError(err)
+	}
+
+	query = `
+		INSERT INTO outbox (message_id, trace_id)
+		VALUES ($1, $2)
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{msg.ID, tid})
+
+	if _, err := tx.ExecContext(ctx, query, msg.ID, tid); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return IdempotencyKey{}, false, err
+	}
+
+	responseStatus, responseBody, err := respond(msg)
+	if err != nil {
+		return IdempotencyKey{}, false, err
+	}
+
+	query = `
+		UPDATE idempotency_keys
+		SET message_id = $2, response_status = $3, response_body = $4
+		WHERE key = $1
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{key, msg.ID, responseStatus})
+
+	if _, err := tx.ExecContext(ctx, query, key, msg.ID, responseStatus, responseBody); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return IdempotencyKey{}, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Debug("failed to commit transaction", "error", err)
+
+		return IdempotencyKey{}, false, err
+	}
+
+	log.Debug("executed query", "saved", true, "result", msg.ID)
+
+	return IdempotencyKey{}, true, nil
+}
+
+func (s *PgStorage) DeleteExpiredIdempotencyKeys(ctx context.Context, ttl time.Duration, limit uint64) (uint64, error) {
+	log := s.log.With(
+		"query", "deleteExpiredIdempotencyKeys",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	// Keys locked by a request taking them over are skipped, the request saves them again.
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE key IN (
+			SELECT key
+			FROM idempotency_keys
+			WHERE created_at < NOW() - $1 * INTERVAL '1 second'
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+	`
+
+	args := []any{ttl.Seconds(), limit}
+
+	log.Debug("build query", "sql", query, "args", args)
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return 0, err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		log.Debug("failed to get rows count", "error", err)
+
+		return 0, err
+	}
+
+	log.Debug("executed query", "count", count)
+
+	return uint64(count), nil
+}
+
+func (s *PgStorage) getIdempotencyKey(ctx context.Context, log *slog.Logger, tx *sql.Tx, key string) (IdempotencyKey, error) {
+	query := `
+		SELECT key, created_at, request_hash, message_id, response_status, response_body
+		FROM idempotency_keys
+		WHERE key = $1
+		LIMIT 1
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{key})
+
+	var (
+		existing       IdempotencyKey
+		msgID          sql.NullInt64
+		responseStatus sql.NullInt32
+	)
+	row := tx.QueryRowContext(ctx, query, key)
+	if err := row.Scan(
+		&existing.Key, &existing.CreatedAt, &existing.RequestHash,
+		&msgID, &responseStatus, &existing.ResponseBody,
+	); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return IdempotencyKey{}, err
+	}
+	existing.MessageID = uint64(msgID.Int64)
+	existing.ResponseStatus = int(responseStatus.Int32)
+
+	return existing, nil
+}
+
+func (s *PgStorage) GetProcessingResults(ctx context.Context, msgID uint64) ([]ProcessingResult, error) {
+	log := s.log.With(
+		"query", "getProcessingResults",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	query := `
+		SELECT id, message_id, processor, result, duration_ns, finished_at
+		FROM processing_results
+		WHERE message_id = $1
+		ORDER BY id
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{msgID})
+
+	rows, err := s.db.QueryContext(ctx, query, msgID)
+	if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	results := make([]ProcessingResult, 0)
+	for rows.Next() {
+		var (
+			res      ProcessingResult
+			duration int64
+		)
+		if err := rows.Scan(&res.ID, &res.MessageID, &res.Processor, &res.Result, &duration, &res.FinishedAt); err != nil {
+			log.Debug("failed to scan row", "error", err)
+
+			return nil, err
+		}
+		res.Duration = time.Duration(duration)
+
+		results = append(results, res)
+	}
+	if err := rows.Err(); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, err
+	}
+
+	log.Debug("executed query", "countResults", len(results))
+
+	return results, nil
+}
+
+func (s *PgStorage) SaveDeadLetters(ctx context.Context, letters []DeadLetter) error {
+	log := s.log.With(
+		"query", "saveDeadLetters",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	if len(letters) == 0 {
+		return nil
+	}
+
+	var (
+		msgIds     = make([]*int64, 0, len(letters))
+		topics     = make([]string, 0, len(letters))
+		partitions = make([]int, 0, len(letters))
+		offsets    = make([]int64, 0, len(letters))
+		attempts   = make([]int, 0, len(letters))
+		errs       = make([]string, 0, len(letters))
+		keys       = make([][]byte, 0, len(letters))
+		values     = make([][]byte, 0, len(letters))
+		types      = make([]string, 0, len(letters))
+		headers    = make([]string, 0, len(letters))
+	)
+	for _, letter := range letters {
+		headersJSON, err := json.Marshal(letter.Headers)
+		if err != nil {
+			return err
+		}
+		if letter.Headers == nil {
+			headersJSON = []byte("{}")
+		}
+
+		var msgID *int64
+		if letter.MessageID != 0 {
+			id := int64(letter.MessageID)
+			msgID = &id
+		}
+
+		msgIds = append(msgIds, msgID)
+		topics = append(topics, letter.SourceTopic)
+		partitions = append(partitions, letter.SourcePartition)
+		offsets = append(offsets, letter.SourceOffset)
+		attempts = append(attempts, letter.Attempts)
+		errs = append(errs, letter.Error)
+		keys = append(keys, letter.Key)
+		values = append(values, letter.Value)
+		types = append(types, letter.ContentType)
+		headers = append(headers, string(headersJSON))
+	}
+
+	query := `
+		INSERT INTO dead_letters (
+			message_id, source_topic, source_partition, source_offset,
+			attempts, error, event_key, event_value, event_content_type, event_headers
+		)
+		SELECT *
+		FROM unnest(
+			$1::bigint[], $2::text[], $3::integer[], $4::bigint[],
+			$5::integer[], $6::text[], $7::bytea[], $8::bytea[], $9::text[], $10::jsonb[]
+		)
+		ON CONFLICT (source_topic, source_partition, source_offset) DO NOTHING
+	`
+
+	args := []any{msgIds, topics, partitions, offsets, attempts, errs, keys, values, types, headers}
+
+	log.Debug("build query", "sql", query, "args", []any{msgIds, topics, partitions, offsets, attempts, errs})
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return pgTranslateError(err)
+	}
+
+	countRows, err := res.RowsAffected()
+	if err != nil {
+		log.Debug("failed to get rows count", "error", err)
+	}
+
+	log.Debug("executed query", "countDeadLetters", countRows)
+
+	return nil
+}
+
+func (s *PgStorage) ListDeadLetters(ctx context.Context, dto ListDeadLettersDTO) ([]DeadLetter, error) {
+	log := s.log.With(
+		"query", "listDeadLetters",
+		TraceIDKey.String(), ctxstore.MustFrom[string](ctx, TraceIDKey),
+	)
+
+	query := `
+		SELECT
+			id, created_at, COALESCE(message_id, 0),
+			source_topic, source_partition, source_offset,
+			attempts, error, event_key, event_value, event_content_type, event_headers
+		FROM dead_letters
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2
+	`
+
+	log.Debug("build query", "sql", query, "args", []any{dto.Cursor, dto.Limit})
+
+	rows, err := s.db.QueryContext(ctx, query, dto.Cursor, dto.Limit)
+	if err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	letters := make([]DeadLetter, 0)
+	for rows.Next() {
+		var (
+			letter      DeadLetter
+			headersJSON []byte
+		)
+		if err := rows.Scan(
+			&letter.ID, &letter.CreatedAt, &letter.MessageID,
+			&letter.SourceTopic, &letter.SourcePartition, &letter.SourceOffset,
+			&letter.Attempts, &letter.Error, &letter.Key, &letter.Value, &letter.ContentType, &headersJSON,
+		); err != nil {
+			log.Debug("failed to scan row", "error", err)
+
+			return nil, err
+		}
+		if err := json.Unmarshal(headersJSON, &letter.Headers); err != nil {
+			return nil, err
+		}
+
+		letters = append(letters, letter)
+	}
+	if err := rows.Err(); err != nil {
+		log.Debug("failed to execute query", "error", err)
+
+		return nil, err
+	}
+
+	log.Debug("executed query", "countDeadLetters", len(letters))
+
+	return letters, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+type ValidationOptions struct {
+	MaxMessageLength int
+	MaxBodySize      int64
+
+	MaxBatchSize     int
+	MaxBatchBodySize int64
+}
+
+// DecodeJSONBody decodes a single JSON value from the request body into dst,
+// rejecting bodies larger than maxBodySize, invalid UTF-8 and unknown fields.
+func DecodeJSONBody(w http.ResponseWriter, r *http.Request, maxBodySize int64, dst any) error {
+	body, err := ReadBody(w, r, maxBodySize)
+	if err != nil {
+		return err
+	}
+
+	return DecodeJSON(body, dst)
+}
+
+// ReadBody reads the whole request body, rejecting bodies larger than maxBodySize and invalid UTF-8.
+func ReadBody(w http.ResponseWriter, r *http.Request, maxBodySize int64) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, NewTooLargeError(fmt.Sprintf("request body must be at most %d bytes", maxBytesErr.Limit))
+		}
+		return nil, err
+	}
+
+	if !utf8.Valid(body) {
+		return nil, invalidBody("must be valid UTF-8")
+	}
+
+	return body, nil
+}
+
+// DecodeJSON decodes a single JSON value into dst, rejecting unknown fields.
+func DecodeJSON(data []byte, dst any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(dst); err != nil {
+		var (
+			syntaxErr        *json.SyntaxError
+			unmarshalTypeErr *json.UnmarshalTypeError
+		)
+		switch {
+		case errors.Is(err, io.EOF):
+			return invalidBody("must not be empty")
+		case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+			return invalidBody("must be valid JSON")
+		case errors.As(err, &unmarshalTypeErr) && unmarshalTypeErr.Field != "":
+			return NewValidationError("invalid request body", FieldError{
+				Field:   unmarshalTypeErr.Field,
+				Message: fmt.Sprintf("must be %s", unmarshalTypeErr.Type),
+			})
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			return NewValidationError("invalid request body", FieldError{
+				Field:   strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`),
+				Message: "unknown field",
+			})
+		default:
+			return invalidBody(err.Error())
+		}
+	}
+
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return invalidBody("must contain a single JSON value")
+	}
+
+	return nil
+}
+
+const MaxRoutingKeyLength = 255
+
+func (dto SaveMessageDTO) Validate(opts ValidationOptions) error {
+	fields := validateMessageText("message", dto.Text, opts)
+	if utf8.RuneCountInString(dto.RoutingKey) > MaxRoutingKeyLength {
+		fields = append(fields, FieldError{
+			Field:   "routingKey",
+			Message: fmt.Sprintf("must be at most %d characters", MaxRoutingKeyLength),
+		})
+	}
+	if len(fields) > 0 {
+		return NewValidationError("invalid message", fields...)
+	}
+	return nil
+}
+
+func validateMessageText(field, text string, opts ValidationOptions) []FieldError {
+	switch {
+	case len(text) == 0:
+		return []FieldError{{Field: field, Message: "must not be empty"}}
+	case strings.TrimSpace(text) == "":
+		return []FieldError{{Field: field, Message: "must not be blank"}}
+	case strings.ContainsRune(text, 0):
+		return []FieldError{{Field: field, Message: "must not contain NUL characters"}}
+	case opts.MaxMessageLength > 0 && utf8.RuneCountInString(text) > opts.MaxMessageLength:
+		return []FieldError{{Field: field, Message: fmt.Sprintf("must be at most %d characters", opts.MaxMessageLength)}}
+	default:
+		return nil
+	}
+}
+
+func invalidBody(message string) *APIError {
+	return NewValidationError("invalid request body", FieldError{Field: "body", Message: message})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrWorkerPoolClosed = errors.New("worker pool closed")
+
+type WorkerPoolOptions struct {
+	Workers     int
+	MaxInFlight int
+}
+
+// WorkerPool runs tasks concurrently on a fixed number of workers.
+// Tasks with the same key always run on the same worker, so they are executed in submission order.
+// Submit blocks while the number of queued and running tasks reaches MaxInFlight.
+type WorkerPool struct {
+	opts WorkerPoolOptions
+	log  *slog.Logger
+
+	shards   []chan func()
+	inFlight chan struct{}
+	next     atomic.Uint64
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func NewWorkerPool(log *slog.Logger, opts WorkerPoolOptions) *WorkerPool {
+	opts.Workers = max(opts.Workers, 1)
+	opts.MaxInFlight = max(opts.MaxInFlight, opts.Workers)
+
+	p := &WorkerPool{
+		opts: opts,
+		log:  log.With("component", "workerPool"),
+
+		shards:   make([]chan func(), opts.Workers),
+		inFlight: make(chan struct{}, opts.MaxInFlight),
+	}
+
+	for i := range p.shards {
+		p.shards[i] = make(chan func(), opts.MaxInFlight)
+
+		p.wg.Add(1)
+		go func(tasks <-chan func()) {
+			defer p.wg.Done()
+			for task := range tasks {
+				task()
+				<-p.inFlight
+			}
+		}(p.shards[i])
+	}
+
+	return p
+}
+
+func (p *WorkerPool) Workers() int {
+	return p.opts.Workers
+}
+
+// Submit queues the task on the worker selected by the key.
+// Tasks without a key are spread between the workers.
+func (p *WorkerPool) Submit(ctx context.Context, key []byte, task func()) error {
+	select {
+	case p.inFlight <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		<-p.inFlight
+		return ErrWorkerPoolClosed
+	}
+
+	// The shard buffer is as large as the in-flight limit, so the send never blocks.
+	p.shards[p.shardFor(key)] <- task
+	return nil
+}
+
+func (p *WorkerPool) shardFor(key []byte) int {
+	if len(key) == 0 {
+		return int(p.next.Add(1) % uint64(len(p.shards)))
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(len(p.shards)))
+}
+
+// Drain stops accepting tasks and waits until the submitted ones are finished.
+func (p *WorkerPool) Drain(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, shard := range p.shards {
+			close(shard)
+		}
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.wg.Wait()
+	}()
+
+	select {
+	case <-done:
+		p.log.Debug("drained")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
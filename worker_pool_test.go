@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolRunsTasksOfKeyInOrder(t *testing.T) {
+	ctx := newTestContext(t)
+	pool := NewWorkerPool(newTestLogger(), WorkerPoolOptions{Workers: 4, MaxInFlight: 100})
+
+	var (
+		mu  sync.Mutex
+		got = make(map[string][]int)
+	)
+	keys := []string{"a", "b", "c"}
+	for i := 0; i < 30; i++ {
+		key := keys[i%len(keys)]
+		if err := pool.Submit(ctx, []byte(key), func() {
+			mu.Lock()
+			defer mu.Unlock()
+			got[key] = append(got[key], i)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pool.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		if len(got[key]) != 10 {
+			t.Fatalf("got %d tasks of key %q, want 10", len(got[key]), key)
+		}
+		for j := 1; j < len(got[key]); j++ {
+			if got[key][j] < got[key][j-1] {
+				t.Fatalf("got tasks %v of key %q out of order", got[key], key)
+			}
+		}
+	}
+
+	if err := pool.Submit(ctx, nil, func() {}); !errors.Is(err, ErrWorkerPoolClosed) {
+		t.Fatalf("got %v after drain, want %v", err, ErrWorkerPoolClosed)
+	}
+}
+
+func TestWorkerPoolSubmitBlocksAtMaxInFlight(t *testing.T) {
+	ctx := newTestContext(t)
+	pool := NewWorkerPool(newTestLogger(), WorkerPoolOptions{Workers: 1, MaxInFlight: 2})
+
+	release := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		if err := pool.Submit(ctx, nil, func() { <-release }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blockedCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := pool.Submit(blockedCtx, nil, func() {}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the submit blocked until the deadline", err)
+	}
+
+	close(release)
+	if err := pool.Submit(ctx, nil, func() {}); err != nil {
+		t.Fatalf("got %v after the tasks finished", err)
+	}
+
+	if err := pool.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+}